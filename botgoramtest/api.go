@@ -0,0 +1,97 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+// Package botgoramtest helps testing bots without network.
+//
+// It provides an in-memory telegram.API recording sent messages, and
+// Conversation to drive the FSM synchronously like a user:
+//
+//	c := botgoramtest.New(t, "MyBot")
+//	store := botgoram.MemoryStore(init)
+//	fsm := botgoram.NewBySender(c.API, store, 1, c.Messages)
+//	// ... add states
+//	c.Drive(fsm, store)
+//	c.User("alice").Sends("/start").ExpectReply("^Welcome").ExpectState("menu")
+package botgoramtest
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/Patrolavia/telegram"
+)
+
+// Sent is a message sent or forwarded by the bot.
+type Sent struct {
+	Chat        string // identifier of the chat
+	Text        string
+	Options     *telegram.Options
+	ForwardFrom string            // identifier of the chat forwarded from, empty if not forwarding
+	ForwardID   int64             // id of forwarded message
+	Message     *telegram.Message // message returned to the bot
+}
+
+// API is an in-memory telegram.API. It records messages sent by the bot.
+type API struct {
+	Me     telegram.Victim
+	lock   sync.Mutex
+	sent   []Sent
+	lastID int64
+}
+
+var _ telegram.API = (*API)(nil)
+
+// NewAPI creates an API for bot with username botName.
+func NewAPI(botName string) *API {
+	return &API{Me: telegram.Victim{ID: 1, FirstName: botName, Username: botName}}
+}
+
+// Sent returns all messages sent by the bot.
+func (a *API) Sent() []Sent {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return append([]Sent(nil), a.sent...)
+}
+
+// Take returns and forgets messages sent by the bot.
+func (a *API) Take() []Sent {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	ret := a.sent
+	a.sent = nil
+	return ret
+}
+
+func (a *API) record(s Sent) *telegram.Message {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.lastID++
+	me := a.Me
+	s.Message = &telegram.Message{
+		ID:   a.lastID,
+		From: &me,
+		Chat: &telegram.Victim{ID: parseID(s.Chat)},
+		Text: s.Text,
+	}
+	a.sent = append(a.sent, s)
+	return s.Message
+}
+
+func (a *API) GetMe() (*telegram.Victim, error) {
+	me := a.Me
+	return &me, nil
+}
+
+func (a *API) SendMessage(chat string, text string, opt *telegram.Options) (*telegram.Message, error) {
+	return a.record(Sent{chat, text, opt, "", 0, nil}), nil
+}
+
+func (a *API) ForwardMessage(chat, from string, msg int64, silent bool) (*telegram.Message, error) {
+	return a.record(Sent{chat, "", nil, from, msg, nil}), nil
+}
+
+// parseID converts chat identifier to id, or 0 if it is channel username.
+func parseID(chat string) int64 {
+	id, _ := strconv.ParseInt(chat, 10, 64)
+	return id
+}
@@ -0,0 +1,277 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoramtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Patrolavia/botgoram"
+	"github.com/Patrolavia/telegram"
+)
+
+// Conversation drives a FSM like users, reporting unmet expectations to t.
+// Each message is sent through the channel the FSM reads from, and waited until
+// processed, so messages are processed in the order they are sent.
+type Conversation struct {
+	API *API
+	// Messages and Queries should be passed to botgoram.NewBySender or NewByChat
+	// and FSM.CallbackQueries, so the FSM never long-polls. Drive does the latter.
+	Messages chan *telegram.Message
+	Queries  chan *telegram.CallbackQuery
+	t        testing.TB
+	fsm      botgoram.FSM
+	store    botgoram.SaveLoader
+	users    map[string]*User
+	lastID   int64
+	now      time.Time
+	results  chan result
+	quit     chan struct{}
+	exited   chan struct{} // closed when Start returns
+	startErr error
+}
+
+// result is what the FSM did with a message.
+type result struct {
+	msg *telegram.Message
+	err error
+}
+
+// wait is how long to wait for the FSM processing a message.
+const wait = 5 * time.Second
+
+// New creates a Conversation with API of bot named botName.
+func New(t testing.TB, botName string) *Conversation {
+	return &Conversation{
+		API:      NewAPI(botName),
+		Messages: make(chan *telegram.Message),
+		Queries:  make(chan *telegram.CallbackQuery),
+		t:        t,
+		users:    make(map[string]*User),
+		now:      time.Unix(1450000000, 0),
+		results:  make(chan result),
+		quit:     make(chan struct{}),
+		exited:   make(chan struct{}),
+	}
+}
+
+// Drive starts the FSM to test, which uses store as SaveLoader. The FSM is
+// stopped when the test finishes.
+//
+// Drive installs a middleware to know when a message is processed, so it must
+// be called before FSM.Use, and Start must not be called.
+func (c *Conversation) Drive(f botgoram.FSM, store botgoram.SaveLoader) *Conversation {
+	c.fsm, c.store = f, store
+	f.Use(c.observe)
+	f.CallbackQueries(c.Queries)
+	go func() {
+		c.startErr = f.Start(0)
+		close(c.exited)
+	}()
+	c.t.Cleanup(c.stop)
+	return c
+}
+
+// observe is a middleware reporting results to the waiting user.
+func (c *Conversation) observe(next botgoram.Handler) botgoram.Handler {
+	return func(u botgoram.Update, current botgoram.State, api telegram.API) (botgoram.State, error) {
+		st, err := next(u, current, api)
+		select {
+		case c.results <- result{u.Message, err}:
+		case <-c.quit:
+		}
+		return st, err
+	}
+}
+
+func (c *Conversation) stop() {
+	close(c.quit)
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	c.fsm.Stop(ctx)
+}
+
+// send calls send in another goroutine to send a message or query to the FSM,
+// and waits until the FSM processed a message accepted by is.
+func (c *Conversation) send(send func(), is func(*telegram.Message) bool) error {
+	timeout := time.After(wait)
+	done := make(chan struct{})
+	go func() {
+		send()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-c.exited:
+		return c.exitErr()
+	case <-timeout:
+		return errors.New("FSM does not receive the message, is it driven?")
+	}
+	for {
+		select {
+		case r := <-c.results:
+			if is(r.msg) {
+				return r.err
+			}
+		case <-c.exited:
+			return c.exitErr()
+		case <-timeout:
+			return errors.New("FSM does not process the message, is Use called before Drive?")
+		}
+	}
+}
+
+func (c *Conversation) exitErr() error {
+	if c.startErr != nil {
+		return fmt.Errorf("FSM stopped: %s", c.startErr)
+	}
+	return errors.New("FSM stopped.")
+}
+
+// User returns the user named name, creating one if not exist.
+func (c *Conversation) User(name string) *User {
+	if u, ok := c.users[name]; ok {
+		return u
+	}
+	v := &telegram.Victim{
+		ID:        int64(len(c.users) + 1000),
+		FirstName: name,
+		Username:  name,
+	}
+	u := &User{c: c, Victim: v}
+	c.users[name] = u
+	return u
+}
+
+// next returns id and date for next message.
+func (c *Conversation) next() (int64, int64) {
+	c.lastID++
+	c.now = c.now.Add(time.Second)
+	return c.lastID, c.now.Unix()
+}
+
+// User is a user talking to the bot in a private chat.
+type User struct {
+	Victim *telegram.Victim
+	c      *Conversation
+	read   int // number of replies checked
+}
+
+// Sends sends a text message.
+func (u *User) Sends(text string) *User {
+	u.c.t.Helper()
+	return u.SendsMessage(&telegram.Message{Text: text})
+}
+
+// SendsMessage sends msg, filling its id, date, sender and chat if not set.
+func (u *User) SendsMessage(msg *telegram.Message) *User {
+	u.c.t.Helper()
+	id, date := u.c.next()
+	if msg.ID == 0 {
+		msg.ID = id
+	}
+	if msg.Date == 0 {
+		msg.Date = date
+	}
+	if msg.From == nil {
+		msg.From = u.Victim
+	}
+	if msg.Chat == nil {
+		chat := *u.Victim
+		chat.Type = "private"
+		msg.Chat = &chat
+	}
+	err := u.c.send(func() {
+		select {
+		case u.c.Messages <- msg:
+		case <-u.c.quit:
+		}
+	}, func(m *telegram.Message) bool { return m == msg })
+	if err != nil {
+		u.c.t.Fatalf("%s sends message#%d: %s", u.Victim.Username, msg.ID, err)
+	}
+	return u
+}
+
+// Presses presses a button with callback data on the last message bot sent to user.
+func (u *User) Presses(data string) *User {
+	u.c.t.Helper()
+	replies := u.replies()
+	if len(replies) == 0 {
+		u.c.t.Fatalf("%s presses button %q, but bot sent nothing", u.Victim.Username, data)
+	}
+	id, _ := u.c.next()
+	q := &telegram.CallbackQuery{
+		ID:      strconv.FormatInt(id, 10),
+		From:    u.Victim,
+		Message: replies[len(replies)-1].Message,
+		Data:    data,
+	}
+	err := u.c.send(func() {
+		select {
+		case u.c.Queries <- q:
+		case <-u.c.quit:
+		}
+	}, func(m *telegram.Message) bool {
+		return m.From == q.From && m.ID == q.Message.ID
+	})
+	if err != nil {
+		u.c.t.Fatalf("%s presses button %q: %s", u.Victim.Username, data, err)
+	}
+	return u
+}
+
+// replies returns messages sent to user.
+func (u *User) replies() (ret []Sent) {
+	for _, s := range u.c.API.Sent() {
+		if s.Chat == u.Victim.Identifier() {
+			ret = append(ret, s)
+		}
+	}
+	return
+}
+
+// ExpectReply expects next message bot sent to user matches regular expression pattern.
+func (u *User) ExpectReply(pattern string) *User {
+	u.c.t.Helper()
+	replies := u.replies()
+	if u.read >= len(replies) {
+		u.c.t.Errorf("Expected reply to %s matching %q, got nothing", u.Victim.Username, pattern)
+		return u
+	}
+	reply := replies[u.read]
+	u.read++
+	if !regexp.MustCompile(pattern).MatchString(reply.Text) {
+		u.c.t.Errorf("Expected reply to %s matching %q, got %q", u.Victim.Username, pattern, reply.Text)
+	}
+	return u
+}
+
+// ExpectNoReply expects bot sent nothing more to user.
+func (u *User) ExpectNoReply() *User {
+	u.c.t.Helper()
+	if replies := u.replies(); u.read < len(replies) {
+		u.c.t.Errorf("Expected no reply to %s, got %q", u.Victim.Username, replies[u.read].Text)
+		u.read = len(replies)
+	}
+	return u
+}
+
+// ExpectState expects user is in state id.
+func (u *User) ExpectState(id string) *User {
+	u.c.t.Helper()
+	sid, _, err := u.c.store.Load(u.Victim.Identifier())
+	if err != nil {
+		u.c.t.Fatalf("Cannot load state of %s: %s", u.Victim.Username, err)
+	}
+	if sid != id {
+		u.c.t.Errorf("Expected %s in state[%s], got state[%s]", u.Victim.Username, id, sid)
+	}
+	return u
+}
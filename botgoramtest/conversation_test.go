@@ -0,0 +1,40 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoramtest
+
+import (
+	"testing"
+
+	"github.com/Patrolavia/botgoram"
+	"github.com/Patrolavia/telegram"
+)
+
+func TestConversation(t *testing.T) {
+	c := New(t, "MyBot")
+	store := botgoram.MemoryStore(func(uid string) interface{} { return "" })
+	f := botgoram.NewBySender(c.API, store, 1, c.Messages)
+
+	reply := func(text string) botgoram.Action {
+		return func(msg *telegram.Message, current botgoram.State, api telegram.API) error {
+			_, err := api.SendMessage(msg.Chat.Identifier(), text, nil)
+			return err
+		}
+	}
+	f.AddState("menu", reply("Welcome, choose one"), nil)
+	f.AddState("pizza", reply("Pizza ordered"), nil)
+	init, _ := f.State(botgoram.InitialState)
+	init.RegisterCommand("/start", func(msg *telegram.Message, state botgoram.State) (string, error) {
+		return "menu", nil
+	})
+	menu, _ := f.State("menu")
+	menu.RegisterCallback("pizza", func(msg *telegram.Message, state botgoram.State) (string, error) {
+		return "pizza", nil
+	})
+	c.Drive(f, store)
+
+	alice := c.User("alice")
+	alice.Sends("/start@MyBot").ExpectReply("^Welcome").ExpectState("menu")
+	c.User("bob").ExpectNoReply().ExpectState(botgoram.InitialState)
+	alice.Presses("pizza").ExpectReply("ordered$").ExpectNoReply().ExpectState("pizza")
+}
@@ -0,0 +1,158 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// Codec converts state id and state data into bytes and back, used by persistent
+// SaveLoaders.
+//
+// State data is stored as interface{}, so codec have to know which concrete type
+// to decode to. Register every type you use as state data before loading.
+//
+// data might be a Record, see Record.
+type Codec interface {
+	// Register tells codec the concrete type of value.
+	Register(value interface{})
+	Encode(w io.Writer, sid string, data interface{}) error
+	Decode(r io.Reader) (sid string, data interface{}, err error)
+}
+
+func typeName(t reflect.Type) string {
+	if t.Kind() == reflect.Ptr {
+		return "*" + typeName(t.Elem())
+	}
+	if t.Name() != "" && t.PkgPath() != "" {
+		return t.PkgPath() + "." + t.Name()
+	}
+	return t.String()
+}
+
+type jsonRecord struct {
+	SID     string          `json:"sid"`
+	Type    string          `json:"type,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	History []string        `json:"history,omitempty"`
+	Calls   []Frame         `json:"calls,omitempty"`
+}
+
+// record splits Record into state data, history and calls.
+func record(data interface{}) (interface{}, []string, []Frame) {
+	if r, ok := data.(Record); ok {
+		return r.Data, r.History, r.Calls
+	}
+	return data, nil, nil
+}
+
+// unrecord is the reverse of record, it returns data as is if there is no
+// history nor calls.
+func unrecord(data interface{}, history []string, calls []Frame) interface{} {
+	if len(history) == 0 && len(calls) == 0 {
+		return data
+	}
+	return Record{data, history, calls}
+}
+
+type jsonCodec struct {
+	lock  sync.RWMutex
+	types map[string]reflect.Type
+}
+
+// JSONCodec stores state in human-readable JSON format, with type name of state data.
+// Common builtin types (string, bool, int, int64, float64, map[string]interface{}
+// and []interface{}) are pre-registered.
+func JSONCodec() Codec {
+	ret := &jsonCodec{types: make(map[string]reflect.Type)}
+	for _, v := range []interface{}{"", false, 0, int64(0), float64(0), map[string]interface{}{}, []interface{}{}} {
+		ret.Register(v)
+	}
+	return ret
+}
+
+func (c *jsonCodec) Register(value interface{}) {
+	t := reflect.TypeOf(value)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.types[typeName(t)] = t
+}
+
+func (c *jsonCodec) Encode(w io.Writer, sid string, data interface{}) (err error) {
+	rec := jsonRecord{SID: sid}
+	data, rec.History, rec.Calls = record(data)
+	if data != nil {
+		rec.Type = typeName(reflect.TypeOf(data))
+		c.lock.RLock()
+		_, ok := c.types[rec.Type]
+		c.lock.RUnlock()
+		if !ok {
+			return fmt.Errorf("Type %s is not registered in codec.", rec.Type)
+		}
+		if rec.Data, err = json.Marshal(data); err != nil {
+			return
+		}
+	}
+	return json.NewEncoder(w).Encode(rec)
+}
+
+func (c *jsonCodec) Decode(r io.Reader) (sid string, data interface{}, err error) {
+	var rec jsonRecord
+	if err = json.NewDecoder(r).Decode(&rec); err != nil {
+		return
+	}
+	sid = rec.SID
+	if rec.Type == "" {
+		return sid, unrecord(nil, rec.History, rec.Calls), nil
+	}
+
+	c.lock.RLock()
+	t, ok := c.types[rec.Type]
+	c.lock.RUnlock()
+	if !ok {
+		return sid, nil, fmt.Errorf("Type %s is not registered in codec.", rec.Type)
+	}
+	v := reflect.New(t)
+	if err = json.Unmarshal(rec.Data, v.Interface()); err != nil {
+		return
+	}
+	return sid, unrecord(v.Elem().Interface(), rec.History, rec.Calls), nil
+}
+
+type gobRecord struct {
+	SID     string
+	Data    interface{}
+	History []string
+	Calls   []Frame
+}
+
+type gobCodec struct{}
+
+// GobCodec stores state in gob format. Register calls gob.Register.
+func GobCodec() Codec {
+	return gobCodec{}
+}
+
+func (c gobCodec) Register(value interface{}) {
+	gob.Register(value)
+}
+
+func (c gobCodec) Encode(w io.Writer, sid string, data interface{}) error {
+	rec := gobRecord{SID: sid}
+	rec.Data, rec.History, rec.Calls = record(data)
+	return gob.NewEncoder(w).Encode(rec)
+}
+
+func (c gobCodec) Decode(r io.Reader) (sid string, data interface{}, err error) {
+	var rec gobRecord
+	if err = gob.NewDecoder(r).Decode(&rec); err != nil {
+		return
+	}
+	return rec.SID, unrecord(rec.Data, rec.History, rec.Calls), nil
+}
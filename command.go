@@ -0,0 +1,154 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"log"
+	"strings"
+	"unicode"
+
+	"github.com/Patrolavia/telegram"
+)
+
+// CommandParser parses commands in text messages. The first word of a text
+// message is the command, and the rest are arguments.
+//
+// Commands sent in groups look like "/start@MyBot", the bot username is stripped
+// if it is BotName, and the message is not treated as command if it is another bot.
+type CommandParser struct {
+	BotName    string            // username of the bot, FSM tries to learn it by GetMe when Start if empty
+	IgnoreCase bool              // match commands case-insensitively, parsed commands are lower-cased
+	Aliases    map[string]string // maps alias to command, like "/h" to "/help"
+}
+
+// Parse parses text into command and arguments. Arguments are separated by
+// whitespaces, and can be quoted like shell, e.g. `/say "hello world"`.
+func (p CommandParser) Parse(text string) (cmd string, args []string, ok bool) {
+	pc := p.parse(text)
+	if pc == nil {
+		return
+	}
+	return pc.cmd, pc.args, true
+}
+
+type parsedCommand struct {
+	cmd  string
+	args []string
+	fold bool
+}
+
+// is reports whether the parsed command is cmd.
+func (pc *parsedCommand) is(cmd string) bool {
+	if pc.fold {
+		return strings.EqualFold(pc.cmd, cmd)
+	}
+	return pc.cmd == cmd
+}
+
+func (p CommandParser) parse(text string) *parsedCommand {
+	if text == "" || unicode.IsSpace([]rune(text)[0]) {
+		return nil
+	}
+	rest := ""
+	cmd := text
+	if i := strings.IndexFunc(text, unicode.IsSpace); i >= 0 {
+		cmd, rest = text[:i], text[i:]
+	}
+
+	if i := strings.LastIndex(cmd, "@"); strings.HasPrefix(cmd, "/") && i > 0 {
+		if p.BotName != "" && !strings.EqualFold(cmd[i+1:], p.BotName) {
+			return nil // sent to another bot
+		}
+		cmd = cmd[:i]
+	}
+	if p.IgnoreCase {
+		cmd = strings.ToLower(cmd)
+	}
+	if alias, ok := lookup(p.Aliases, cmd, p.IgnoreCase); ok {
+		cmd = p.Aliases[alias]
+	}
+
+	return &parsedCommand{cmd, splitArgs(rest), p.IgnoreCase}
+}
+
+// lookup finds key in m, or the least key equal to key under case folding if
+// fold is true, so the result never depends on map order.
+func lookup[V any](m map[string]V, key string, fold bool) (string, bool) {
+	if _, ok := m[key]; ok || !fold {
+		return key, ok
+	}
+	found, ok := "", false
+	for k := range m {
+		if strings.EqualFold(k, key) && (!ok || k < found) {
+			found, ok = k, true
+		}
+	}
+	return found, ok
+}
+
+// splitArgs splits s by whitespaces, respecting quotes and backslash escapes.
+// Unterminated quote lasts to the end.
+func splitArgs(s string) (ret []string) {
+	var (
+		buf     strings.Builder
+		inArg   bool
+		quote   rune
+		escaped bool
+	)
+	for _, r := range s {
+		switch {
+		case escaped:
+			buf.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				buf.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote, inArg = r, true
+		case unicode.IsSpace(r):
+			if inArg {
+				ret = append(ret, buf.String())
+				buf.Reset()
+				inArg = false
+			}
+		default:
+			buf.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		ret = append(ret, buf.String())
+	}
+	return
+}
+
+func (f *fsm) SetCommandParser(p CommandParser) {
+	f.parser = p
+}
+
+// learnBotName fills BotName of command parser by GetMe. Failing to learn it
+// is not fatal: commands sent to other bots are accepted until next Start.
+func (f *fsm) learnBotName() {
+	if f.parser.BotName != "" || f.api == nil {
+		return
+	}
+	me, err := f.api.GetMe()
+	if err != nil {
+		log.Printf("botgoram: cannot learn bot username, commands to other bots are not filtered: %s", err)
+		return
+	}
+	f.parser.BotName = me.Username
+}
+
+// parseCommand parses command in msg for st.
+func (f *fsm) parseCommand(st State, msg *telegram.Message) {
+	if msgType(msg) == TextMsg {
+		st.setCommand(f.parser.parse(msg.Text))
+	}
+}
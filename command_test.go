@@ -0,0 +1,76 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Patrolavia/telegram"
+)
+
+func TestCommandParser(t *testing.T) {
+	p := CommandParser{BotName: "MyBot", Aliases: map[string]string{"/h": "/help"}}
+	fold := p
+	fold.IgnoreCase = true
+	colliding := CommandParser{IgnoreCase: true, Aliases: map[string]string{
+		"/H": "/x", "/h": "/help", "/hH": "/b", "/Hh": "/a",
+	}}
+	cases := []struct {
+		parser CommandParser
+		text   string
+		cmd    string
+		args   []string
+		ok     bool
+	}{
+		{p, "/start", "/start", nil, true},
+		{p, "/start@mybot now", "/start", []string{"now"}, true},
+		{p, "/start@OtherBot", "", nil, false},
+		{p, "/h", "/help", nil, true},
+		{p, "hello world", "hello", []string{"world"}, true},
+		{p, " /start", "", nil, false},
+		{p, `/say "hello world" it\'s 'a "b"' c\ d`, "/say", []string{"hello world", "it's", `a "b"`, "c d"}, true},
+		{p, `/say "unterminated`, "/say", []string{"unterminated"}, true},
+		{p, "/H", "/H", nil, true},
+		{fold, "/H", "/help", nil, true},
+		{colliding, "/H", "/help", nil, true},
+		{colliding, "/HH", "/a", nil, true},
+	}
+	for _, c := range cases {
+		cmd, args, ok := c.parser.Parse(c.text)
+		if ok != c.ok || cmd != c.cmd || fmt.Sprintf("%q", args) != fmt.Sprintf("%q", c.args) {
+			t.Errorf("Parsing %q: expected %s %q %v, got %s %q %v", c.text, c.cmd, c.args, c.ok, cmd, args, ok)
+		}
+	}
+}
+
+func TestCommandParserInFSM(t *testing.T) {
+	u := makeTestUser("user1")
+	ch := make(chan *telegram.Message)
+	store := MemoryStore(func(uid string) interface{} { return "" })
+	f := NewBySender(nil, store, 1, ch)
+	f.SetCommandParser(CommandParser{BotName: "MyBot", IgnoreCase: true})
+	f.AddState("started", func(msg *telegram.Message, current State, api telegram.API) error {
+		if current.Command() != "/start" || len(current.Args()) != 1 || current.Args()[0] != "a b" {
+			t.Errorf("Unexpected command in enter action: %s %q", current.Command(), current.Args())
+		}
+		return nil
+	}, nil)
+	init, _ := f.State(InitialState)
+	init.RegisterCommand("/Start", func(msg *telegram.Message, state State) (string, error) {
+		return "started", nil
+	})
+	init.RegisterFallback(func(msg *telegram.Message, state State) (string, error) {
+		return InitialState, nil
+	})
+
+	go f.Start(0)
+	ch <- &telegram.Message{ID: 1, Text: "/start@OtherBot", From: u, Chat: u}
+	ch <- &telegram.Message{ID: 2, Text: `/START@mybot "a b"`, From: u, Chat: u}
+	stopFSM(t, f)
+
+	if sid, _, _ := store.Load(u.Identifier()); sid != "started" {
+		t.Errorf("Expected command matches case-insensitively, got state[%s]", sid)
+	}
+}
@@ -0,0 +1,64 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Patrolavia/telegram"
+)
+
+// PanicError is returned when an Action, Transitor or SaveLoader panics.
+type PanicError struct {
+	Value interface{} // value passed to panic()
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("Panic while processing message: %v", e.Value)
+}
+
+// RetryPolicy decides whether to retry a message, which has failed attempts
+// times. err is the last error.
+type RetryPolicy func(attempts int, err error) bool
+
+// MaxAttempts creates a RetryPolicy which retries a message until it fails n times.
+func MaxAttempts(n int) RetryPolicy {
+	return func(attempts int, err error) bool {
+		return attempts < n
+	}
+}
+
+// Backoff returns how long to wait before retrying a message, which has failed
+// attempts times.
+type Backoff func(attempts int) time.Duration
+
+// ExponentialBackoff creates a Backoff which waits base before first retry, and
+// doubles the delay for each retry, up to max.
+func ExponentialBackoff(base, max time.Duration) Backoff {
+	return func(attempts int) time.Duration {
+		d := base
+		for i := 1; i < attempts && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		return d
+	}
+}
+
+// DeadLetter receives poison messages, which failed too many times.
+type DeadLetter interface {
+	// sid is the state id of user when the message fails.
+	DeadLetter(msg *telegram.Message, user *telegram.Victim, sid string, err error)
+}
+
+// DeadLetterFunc is an adapter to use ordinary function as DeadLetter.
+type DeadLetterFunc func(msg *telegram.Message, user *telegram.Victim, sid string, err error)
+
+func (f DeadLetterFunc) DeadLetter(msg *telegram.Message, user *telegram.Victim, sid string, err error) {
+	f(msg, user, sid, err)
+}
@@ -0,0 +1,106 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Patrolavia/telegram"
+)
+
+func makePoisonFSM(store SaveLoader, ch chan *telegram.Message, calls *int) FSM {
+	f := NewBySender(nil, store, 1, ch)
+	f.AddState("poison", func(msg *telegram.Message, current State, api telegram.API) error {
+		*calls++
+		panic("poisoned")
+	}, nil)
+	f.AddState("good", nil, nil)
+	init, _ := f.State(InitialState)
+	init.RegisterFallback(func(msg *telegram.Message, state State) (string, error) {
+		if msg.Text == "poison" {
+			return "poison", nil
+		}
+		return "good", nil
+	})
+	return f
+}
+
+func TestDeadLetter(t *testing.T) {
+	u1 := makeTestUser("user1")
+	ch := make(chan *telegram.Message)
+	store := MemoryStore(func(uid string) interface{} { return nil })
+	calls := 0
+	f := makePoisonFSM(store, ch, &calls)
+
+	type letter struct {
+		msg *telegram.Message
+		sid string
+		err error
+	}
+	letters := make(chan letter, 1)
+	f.SetRetryPolicy(MaxAttempts(3))
+	f.SetBackoff(ExponentialBackoff(50*time.Millisecond, time.Second))
+	f.SetDeadLetter(DeadLetterFunc(func(msg *telegram.Message, user *telegram.Victim, sid string, err error) {
+		letters <- letter{msg, sid, err}
+	}))
+
+	begin := time.Now()
+	go f.Start(0)
+	defer stopFSM(t, f)
+	ch <- &telegram.Message{ID: 1, Text: "poison", From: u1, Chat: u1}
+	ch <- &telegram.Message{ID: 2, Text: "good", From: u1, Chat: u1}
+
+	select {
+	case l := <-letters:
+		if _, ok := l.err.(*PanicError); !ok || l.msg.ID != 1 || l.sid != InitialState {
+			t.Errorf("Unexpected dead letter: msg#%d in state[%s], err %v", l.msg.ID, l.sid, l.err)
+		}
+		if elapsed := time.Since(begin); elapsed < 150*time.Millisecond {
+			t.Errorf("Expected retries to back off 50ms and 100ms, got dead letter after %s", elapsed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Poison message is not sent to dead letter.")
+	}
+	if sid := waitState(store, u1.Identifier(), "good", 2*time.Second); sid != "good" {
+		t.Errorf("Worker should keep working after dead letter, got state[%s]", sid)
+	}
+	if calls != 3 {
+		t.Errorf("Expected 3 attempts, got %d", calls)
+	}
+}
+
+func TestPanicStopsWorkerByDefault(t *testing.T) {
+	u1 := makeTestUser("user1")
+	ch := make(chan *telegram.Message)
+	calls := 0
+	f := makePoisonFSM(MemoryStore(func(uid string) interface{} { return nil }), ch, &calls)
+
+	result := make(chan error)
+	go func() { result <- f.Start(0) }()
+	ch <- &telegram.Message{ID: 1, Text: "poison", From: u1, Chat: u1}
+
+	if perr, ok := (<-result).(*PanicError); !ok || perr.Value != "poisoned" {
+		t.Errorf("Expected PanicError, got %v", perr)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := ExponentialBackoff(time.Second, 5*time.Second)
+	cases := []struct {
+		attempts int
+		expect   time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{40, 5 * time.Second},
+	}
+	for _, c := range cases {
+		if d := b(c.attempts); d != c.expect {
+			t.Errorf("Expected %s for %d attempts, got %s", c.expect, c.attempts, d)
+		}
+	}
+}
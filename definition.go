@@ -0,0 +1,582 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Patrolavia/telegram"
+	"gopkg.in/yaml.v3"
+)
+
+// Registry holds Go code referred by name in state definition file.
+type Registry struct {
+	Actions       map[string]Action
+	Transitors    map[string]Transitor
+	Guards        map[string]func(msg *telegram.Message, state State) bool
+	ErrorHandlers map[string]ErrorHandler
+}
+
+// DefinitionError is a problem found at line Line of state definition file.
+type DefinitionError struct {
+	Line int
+	Msg  string
+}
+
+func (e DefinitionError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// DefinitionErrors lists all problems found in state definition file.
+type DefinitionErrors []DefinitionError
+
+func (e DefinitionErrors) Error() string {
+	desc := make([]string, len(e))
+	for i, err := range e {
+		desc[i] = err.Error()
+	}
+	return "Invalid state definition: " + strings.Join(desc, "; ")
+}
+
+// definition is the content of state definition file.
+type definition struct {
+	States []stateDef `json:"states"`
+}
+
+type stateDef struct {
+	Name        string          `json:"name"`
+	Parent      string          `json:"parent"`
+	Enter       string          `json:"enter"` // name of Action in Registry
+	Leave       string          `json:"leave"` // name of Action in Registry
+	OnError     string          `json:"on_error"`
+	ErrorState  string          `json:"error_state"`
+	Unrecorded  bool            `json:"unrecorded"`
+	Transitions []transitionDef `json:"transitions"`
+}
+
+type transitionDef struct {
+	From      string  `json:"from"`
+	Global    bool    `json:"global"`
+	Type      string  `json:"type"`
+	Command   string  `json:"command"`
+	Callback  *string `json:"callback"` // callback data prefix
+	Timeout   string  `json:"timeout"`  // parsed by time.ParseDuration
+	Text      string  `json:"text"`
+	Regexp    string  `json:"regexp"`
+	Guard     string  `json:"guard"`     // name of guard in Registry
+	Transitor string  `json:"transitor"` // name of Transitor in Registry
+	Call      string  `json:"call"`
+	Fallback  bool    `json:"fallback"`
+	Edited    bool    `json:"edited"`
+	Forward   bool    `json:"forward"`
+	Reply     bool    `json:"reply"`
+	Hidden    bool    `json:"hidden"`
+	Desc      string  `json:"desc"`
+}
+
+// definedState is a StateMaker loaded from state definition file.
+type definedState struct {
+	name         string
+	parent       string
+	enter, leave Action
+	onError      ErrorHandler
+	errorState   string
+	unrecorded   bool
+	trans        []TransitorMap
+}
+
+func (s *definedState) Name() string                               { return s.name }
+func (s *definedState) Actions() (Action, Action)                  { return s.enter, s.leave }
+func (s *definedState) Transitors() []TransitorMap                 { return s.trans }
+func (s *definedState) Parent() string                             { return s.parent }
+func (s *definedState) Unrecorded() bool                           { return s.unrecorded }
+func (s *definedState) ErrorRecovery() (h ErrorHandler, es string) { return s.onError, s.errorState }
+
+// ParseDefinition reads state definition in JSON or YAML, resolving names of actions,
+// transitors, guards and error handlers in reg. Errors are reported as
+// DefinitionErrors, pointing at line numbers in r.
+//
+// The definition is an object with "states", a list of states like
+//
+//	{
+//		"name": "menu",
+//		"enter": "showMenu",
+//		"transitions": [
+//			{"from": "", "command": "/start"},
+//			{"from": "menu", "regexp": "^\\d+$", "guard": "isAdmin"},
+//			{"from": "order", "transitor": "toMenu", "desc": "cancel"}
+//		]
+//	}
+//
+// Fields of state are name, parent, enter, leave, on_error, error_state and
+// unrecorded, see Nested, ErrorRecoverer and Unrecorded. A transition transits
+// from state "from" to the state declaring it, with fields corresponding to
+// TransitorMap: global, type, command, callback, timeout (like "1m30s"), call,
+// fallback, edited, forward, reply, hidden and desc. Transitor is the named
+// Transitor, or matchers built from text, regexp and guard if not set. A
+// transition having neither always transits when registered message arrives.
+//
+// Definitions not starting with "{" are YAML, like
+//
+//	states:
+//	  - name: menu
+//	    enter: showMenu
+//	    transitions:
+//	      - {from: "", command: /start}
+//	      - from: menu
+//	        regexp: ^\d+$
+//
+// Only the first document of YAML is read.
+func ParseDefinition(r io.Reader, reg Registry) ([]StateMaker, error) {
+	sms, _, err := parseDefinition(r, reg)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]StateMaker, len(sms))
+	for i, s := range sms {
+		ret[i] = s
+	}
+	return ret, nil
+}
+
+// parseDefinition returns the parser for reporting more errors.
+func parseDefinition(r io.Reader, reg Registry) ([]*definedState, *parser, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] != '{' {
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, nil, err
+		}
+	}
+	l := &lines{data: data, at: make(map[string]int), keys: make(map[string][]string)}
+	if err = l.scan(); err != nil {
+		return nil, nil, l.errorAt(err)
+	}
+	var def definition
+	if err = json.Unmarshal(data, &def); err != nil {
+		return nil, nil, l.errorAt(err)
+	}
+
+	p := &parser{lines: l, reg: reg}
+	p.unknownKeys("", definition{})
+	ret := make([]*definedState, 0, len(def.States))
+	names := make(map[string]int)
+	for i, sd := range def.States {
+		path := "states." + strconv.Itoa(i)
+		switch line, ok := names[sd.Name]; {
+		case sd.Name == "":
+			p.errorf(path, "State has no name.")
+		case ok:
+			p.errorf(path+".name", "State %s is already defined at line %d.", sd.Name, line)
+		default:
+			names[sd.Name] = l.of(path + ".name")
+		}
+		ret = append(ret, p.state(path, sd))
+	}
+	if len(p.errs) > 0 {
+		sort.SliceStable(p.errs, func(i, j int) bool { return p.errs[i].Line < p.errs[j].Line })
+		return nil, nil, p.errs
+	}
+	return ret, p, nil
+}
+
+// LoadDefinition parses state definition by ParseDefinition, and registers the
+// states by FSM.MakeState. States referred by the definition must be defined
+// in it or registered before. Nothing is registered if there is any error.
+func LoadDefinition(f FSM, r io.Reader, reg Registry) ([]State, error) {
+	sms, p, err := parseDefinition(r, reg)
+	if err != nil {
+		return nil, err
+	}
+
+	defined := make(map[string]bool)
+	for _, sm := range sms {
+		defined[sm.Name()] = true
+	}
+	known := func(id, path, format string) {
+		if _, ok := f.State(id); id != InitialState && !defined[id] && !ok {
+			p.errorf(path, format, id)
+		}
+	}
+	for i, s := range sms {
+		path := "states." + strconv.Itoa(i)
+		if _, ok := f.State(s.name); ok {
+			p.errorf(path+".name", "State %s is already registered.", s.name)
+		}
+		if _, ok := f.Subflow(s.name); ok {
+			p.errorf(path+".name", "State %s is used as subflow name.", s.name)
+		}
+		if s.parent != "" {
+			known(s.parent, path+".parent", "Parent state %s is not defined.")
+		}
+		if s.errorState != "" {
+			known(s.errorState, path+".error_state", "Error state %s is not defined.")
+		}
+		for j, t := range s.trans {
+			if !t.IsGlobal {
+				known(t.State, path+".transitions."+strconv.Itoa(j)+".from", "State %s is not defined.")
+			}
+		}
+	}
+	if len(p.errs) > 0 {
+		return nil, p.errs
+	}
+
+	ret := make([]State, 0, len(sms))
+	for _, sm := range sms {
+		st, err := f.MakeState(sm)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, st)
+	}
+	return ret, nil
+}
+
+// parser converts decoded definition to StateMakers, collecting errors.
+type parser struct {
+	*lines
+	reg  Registry
+	errs DefinitionErrors
+}
+
+func (p *parser) errorf(path, format string, args ...interface{}) {
+	p.errs = append(p.errs, DefinitionError{p.of(path), fmt.Sprintf(format, args...)})
+}
+
+// unknownKeys reports keys of object at path which are not fields of v.
+func (p *parser) unknownKeys(path string, v interface{}) {
+	fields := make(map[string]bool)
+	t := reflect.TypeOf(v)
+	for i := 0; i < t.NumField(); i++ {
+		fields[t.Field(i).Tag.Get("json")] = true
+	}
+	for _, k := range p.keys[path] {
+		if !fields[k] {
+			p.errorf(join(path, k), "Unknown field %s.", k)
+		}
+	}
+}
+
+func (p *parser) state(path string, sd stateDef) *definedState {
+	p.unknownKeys(path, sd)
+	s := &definedState{
+		name:       sd.Name,
+		parent:     sd.Parent,
+		errorState: sd.ErrorState,
+		unrecorded: sd.Unrecorded,
+	}
+	action := func(key, name string) Action {
+		if name == "" {
+			return nil
+		}
+		a, ok := p.reg.Actions[name]
+		if !ok {
+			p.errorf(path+"."+key, "Action %s is not in registry.", name)
+		}
+		return a
+	}
+	s.enter, s.leave = action("enter", sd.Enter), action("leave", sd.Leave)
+	if sd.OnError != "" {
+		var ok bool
+		if s.onError, ok = p.reg.ErrorHandlers[sd.OnError]; !ok {
+			p.errorf(path+".on_error", "Error handler %s is not in registry.", sd.OnError)
+		}
+	}
+
+	for i, td := range sd.Transitions {
+		s.trans = append(s.trans, p.transition(path+".transitions."+strconv.Itoa(i), sd.Name, td))
+	}
+	return s
+}
+
+func (p *parser) transition(path, name string, td transitionDef) (t TransitorMap) {
+	p.unknownKeys(path, td)
+	t = TransitorMap{
+		State:      td.From,
+		IsGlobal:   td.Global,
+		IsHidden:   td.Hidden,
+		IsFallback: td.Fallback,
+		IsEdited:   td.Edited,
+		IsForward:  td.Forward,
+		IsReply:    td.Reply,
+		Type:       td.Type,
+		Command:    td.Command,
+		Call:       td.Call,
+		Desc:       td.Desc,
+	}
+	if td.Command != "" && td.Type == "" {
+		t.Type = TextMsg
+	}
+	if td.Callback != nil {
+		t.IsCallback, t.Callback = true, *td.Callback
+	}
+	if td.Timeout != "" {
+		d, err := time.ParseDuration(td.Timeout)
+		if err != nil || d <= 0 {
+			p.errorf(path+".timeout", "Invalid timeout %q.", td.Timeout)
+		}
+		t.Timeout = d
+	}
+
+	var ms []Matcher
+	if td.Text != "" {
+		ms = append(ms, Text(td.Text))
+	}
+	if td.Regexp != "" {
+		if re, err := regexp.Compile(td.Regexp); err != nil {
+			p.errorf(path+".regexp", "Invalid regexp: %s", err)
+		} else {
+			ms = append(ms, regexpMatcher{re})
+		}
+	}
+	if td.Guard != "" {
+		if g, ok := p.reg.Guards[td.Guard]; ok {
+			ms = append(ms, Guard(td.Guard, g))
+		} else {
+			p.errorf(path+".guard", "Guard %s is not in registry.", td.Guard)
+		}
+	}
+	switch len(ms) {
+	case 0:
+	case 1:
+		t.Match = ms[0]
+	default:
+		t.Match = And(ms...)
+	}
+
+	if td.Transitor != "" {
+		var ok bool
+		if t.Transitor, ok = p.reg.Transitors[td.Transitor]; !ok {
+			p.errorf(path+".transitor", "Transitor %s is not in registry.", td.Transitor)
+		}
+		if t.Match != nil {
+			p.errorf(path+".transitor", "Transitor cannot be used with text, regexp or guard.")
+		}
+	}
+	cond := t.Type != "" || t.IsCallback || t.IsFallback || t.IsEdited || t.IsForward || t.IsReply
+	switch {
+	case td.Transitor != "", td.Text != "", td.Regexp != "", td.Guard != "":
+	case td.Timeout != "", t.IsHidden, t.Call != "":
+	case cond:
+		// always transit to this state, like a command without arguments
+		t.Transitor = func(msg *telegram.Message, state State) (string, error) { return name, nil }
+	default:
+		p.errorf(path, "Transition has no condition.")
+	}
+	return
+}
+
+// lines records line numbers of values and keys of objects in JSON document,
+// addressed by path like "states.0.transitions.1.from".
+type lines struct {
+	data []byte
+	at   map[string]int
+	keys map[string][]string
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// line returns line number of token starting at or after offset off.
+func (l *lines) line(off int64) int {
+	for off < int64(len(l.data)) && strings.IndexByte(" \t\r\n,:", l.data[off]) >= 0 {
+		off++
+	}
+	return 1 + bytes.Count(l.data[:off], []byte("\n"))
+}
+
+// of returns line number of path, or its nearest ancestor if not present.
+func (l *lines) of(path string) int {
+	for {
+		if line, ok := l.at[path]; ok {
+			return line
+		}
+		pos := strings.LastIndexByte(path, '.')
+		if pos < 0 {
+			return l.at[""]
+		}
+		path = path[:pos]
+	}
+}
+
+// errorAt converts errors of encoding/json to DefinitionErrors.
+func (l *lines) errorAt(err error) error {
+	var (
+		se *json.SyntaxError
+		te *json.UnmarshalTypeError
+	)
+	switch {
+	case errors.As(err, &se):
+		return DefinitionErrors{{1 + bytes.Count(l.data[:se.Offset], []byte("\n")), se.Error()}}
+	case errors.As(err, &te):
+		msg := fmt.Sprintf("Expected %s for %s, got %s.", te.Type, te.Field, te.Value)
+		return DefinitionErrors{{1 + bytes.Count(l.data[:te.Offset], []byte("\n")), msg}}
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return DefinitionErrors{{1 + bytes.Count(l.data, []byte("\n")), "Unexpected end of file."}}
+	}
+	return err
+}
+
+func (l *lines) scan() error {
+	dec := json.NewDecoder(bytes.NewReader(l.data))
+	if err := l.value(dec, ""); err != nil {
+		return err
+	}
+	off := dec.InputOffset()
+	switch _, err := dec.Token(); err {
+	case io.EOF:
+		return nil
+	case nil:
+		return DefinitionErrors{{l.line(off), "Unexpected data after definition."}}
+	default:
+		return err
+	}
+}
+
+func (l *lines) value(dec *json.Decoder, path string) error {
+	l.at[path] = l.line(dec.InputOffset())
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok {
+	case json.Delim('{'):
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			k := key.(string)
+			l.keys[path] = append(l.keys[path], k)
+			if err = l.value(dec, join(path, k)); err != nil {
+				return err
+			}
+		}
+	case json.Delim('['):
+		for i := 0; dec.More(); i++ {
+			if err = l.value(dec, join(path, strconv.Itoa(i))); err != nil {
+				return err
+			}
+		}
+	default:
+		return nil
+	}
+	_, err = dec.Token()
+	return err
+}
+
+// yamlError is error message of gopkg.in/yaml.v3 with line number.
+var yamlError = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// yamlToJSON converts YAML state definition to JSON, keeping every value at its
+// line in YAML, so errors found in JSON point at lines of the YAML document.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		if m := yamlError.FindStringSubmatch(err.Error()); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			return nil, DefinitionErrors{{line, m[2]}}
+		}
+		return nil, DefinitionErrors{{1, err.Error()}}
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	w := &jsonLines{line: 1}
+	if err := w.write(doc.Content[0], doc.Content[0].Line); err != nil {
+		return nil, err
+	}
+	return w.buf.Bytes(), nil
+}
+
+// jsonLines writes JSON, putting values at given lines.
+type jsonLines struct {
+	buf  bytes.Buffer
+	line int
+}
+
+func (w *jsonLines) at(line int) {
+	for ; w.line < line; w.line++ {
+		w.buf.WriteByte('\n')
+	}
+}
+
+// write writes n, collections start at line, which is line of their key.
+func (w *jsonLines) write(n *yaml.Node, line int) error {
+	switch n.Kind {
+	case yaml.AliasNode:
+		return w.write(n.Alias, line)
+	case yaml.MappingNode:
+		w.at(line)
+		w.buf.WriteByte('{')
+		keys := make(map[string]bool)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			if k.Kind != yaml.ScalarNode {
+				return DefinitionErrors{{k.Line, "Key of mapping must be scalar."}}
+			}
+			if keys[k.Value] {
+				return DefinitionErrors{{k.Line, fmt.Sprintf("Duplicate key %s.", k.Value)}}
+			}
+			keys[k.Value] = true
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			w.at(k.Line)
+			key, _ := json.Marshal(k.Value)
+			w.buf.Write(key)
+			w.buf.WriteByte(':')
+			if err := w.write(v, k.Line); err != nil {
+				return err
+			}
+		}
+		w.buf.WriteByte('}')
+	case yaml.SequenceNode:
+		w.at(line)
+		w.buf.WriteByte('[')
+		for i, item := range n.Content {
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			if err := w.write(item, item.Line); err != nil {
+				return err
+			}
+		}
+		w.buf.WriteByte(']')
+	default:
+		w.at(n.Line)
+		var v interface{} = n.Value
+		switch n.ShortTag() {
+		case "!!null":
+			v = nil
+		case "!!bool", "!!int", "!!float":
+			if err := n.Decode(&v); err != nil {
+				return DefinitionErrors{{n.Line, err.Error()}}
+			}
+		}
+		data, err := json.Marshal(v)
+		if err != nil { // like .inf
+			data, _ = json.Marshal(n.Value)
+		}
+		w.buf.Write(data)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Patrolavia/telegram"
+)
+
+const testDefinition = `{
+	"states": [
+		{
+			"name": "menu",
+			"enter": "greet",
+			"transitions": [
+				{"from": "", "command": "/start", "desc": "greet"},
+				{"global": true, "command": "/menu"}
+			]
+		},
+		{
+			"name": "number",
+			"parent": "menu",
+			"error_state": "menu",
+			"on_error": "sorry",
+			"transitions": [
+				{"from": "menu", "regexp": "^(\\d+)$", "guard": "isAdmin"},
+				{"from": "menu", "timeout": "1m"}
+			]
+		},
+		{
+			"name": "echo",
+			"unrecorded": true,
+			"transitions": [{"from": "menu", "type": "TEXT", "transitor": "toEcho"}]
+		}
+	]
+}`
+
+func testRegistry() Registry {
+	action := func(msg *telegram.Message, current State, api telegram.API) error { return nil }
+	return Registry{
+		Actions: map[string]Action{"greet": action},
+		Transitors: map[string]Transitor{
+			"toEcho": func(msg *telegram.Message, state State) (string, error) { return "echo", nil },
+		},
+		Guards: map[string]func(msg *telegram.Message, state State) bool{
+			"isAdmin": func(msg *telegram.Message, state State) bool { return msg.From.Username == "admin" },
+		},
+		ErrorHandlers: map[string]ErrorHandler{
+			"sorry": func(msg *telegram.Message, current State, err error, api telegram.API) error { return nil },
+		},
+	}
+}
+
+func TestLoadDefinition(t *testing.T) {
+	f := NewBySender(nil, MemoryStore(nil), 1, make(chan *telegram.Message)).(*fsm)
+	states, err := LoadDefinition(f, strings.NewReader(testDefinition), testRegistry())
+	if err != nil {
+		t.Fatalf("Cannot load definition: %s", err)
+	}
+	if len(states) != 3 || states[1].Parent() != "menu" || states[2].recorded() {
+		t.Fatalf("Unexpected states %v", states)
+	}
+	if h, es := states[1].errorHandler(); h == nil || es != "menu" {
+		t.Errorf("Expected error handler of number, got %v and state[%s]", h, es)
+	}
+	if enter, _ := f.sm[0].Actions(); enter == nil {
+		t.Errorf("Expected enter action of menu")
+	}
+	if err := f.registerStateMapTransitors(); err != nil {
+		t.Fatalf("Cannot register transitors: %s", err)
+	}
+
+	menu, _ := f.State("menu")
+	initial, _ := f.State(InitialState)
+	user := &telegram.Victim{Username: "user"}
+	admin := &telegram.Victim{Username: "admin"}
+	cases := []struct {
+		st   State
+		msg  *telegram.Message
+		next string
+	}{
+		{initial, &telegram.Message{Text: "/start", From: user}, "menu"},
+		{menu, &telegram.Message{Text: "42", From: admin}, "number"},
+		{menu, &telegram.Message{Text: "42", From: user}, "echo"},
+	}
+	for _, c := range cases {
+		next, err := c.st.clone(c.msg.From).test(c.msg)
+		if err != nil || next != c.next {
+			t.Errorf("Expected %q from state[%s] transits to %s, got state[%s], err %v", c.msg.Text, c.st.ID(), c.next, next, err)
+		}
+	}
+	if d := menu.delay(); d == nil || d.duration != time.Minute || d.id != "number" {
+		t.Errorf("Expected timeout transitor of menu, got %+v", d)
+	}
+
+	g := f.Graph("start")
+	if len(g.Edges) != 6 || g.Edges[1].From != AnyState || g.Edges[4].Match != `text =~ /^(\d+)$/ && guard: isAdmin` {
+		t.Errorf("Unexpected graph %+v", g.Edges)
+	}
+}
+
+func TestDefinitionErrors(t *testing.T) {
+	cases := []struct {
+		doc    string
+		expect string
+	}{
+		{"{\n\"states\": [\n{\"name\": \"a\",}]}", "line 3: invalid character"},
+		{"{\n\"states\": [\n{\"name\": 1}]}", "line 3: Expected string for states.0.name, got number."},
+		{"{\"states\": []}\n{}", "line 2: Unexpected data after definition."},
+		{"{\n\"states\": [\n{\"name\": \"a\"}", "line 3: unexpected end of JSON input"},
+		{"{\n\"states\": [\n{\"name\": \"a\"},\n\n{\"name\": \"a\"}]}", "line 5: State a is already defined at line 3."},
+		{"{\n\"stats\": []}", "line 2: Unknown field stats."},
+		{"{\"states\": [{\n\"name\": \"a\",\n\"enter\": \"nope\",\n\"transitions\": [\n{\"from\": \"\", \"timeout\": \"soon\"},\n{\"from\": \"\",\n\"regexp\": \"(\"},\n{\"from\": \"\", \"gurad\": \"x\"}]}]}",
+			"line 3: Action nope is not in registry.; line 5: Invalid timeout \"soon\".; line 7: Invalid regexp: error parsing regexp: missing closing ): `(`; line 8: Unknown field gurad.; line 8: Transition has no condition."},
+		{"{\"states\": [{\"name\": \"a\",\n\"transitions\": [\n{\"from\": \"\", \"text\": \"hi\", \"transitor\": \"toEcho\"},\n{\"from\": \"\", \"gurad\": \"x\"}]}]}",
+			"line 3: Transitor cannot be used with text, regexp or guard.; line 4: Unknown field gurad.; line 4: Transition has no condition."},
+	}
+	for _, c := range cases {
+		_, err := ParseDefinition(strings.NewReader(c.doc), testRegistry())
+		if _, ok := err.(DefinitionErrors); !ok || !strings.Contains(err.Error(), c.expect) {
+			t.Errorf("Expected error %q for %q, got %v", c.expect, c.doc, err)
+		}
+	}
+
+	f := NewBySender(nil, MemoryStore(nil), 1, make(chan *telegram.Message))
+	f.AddState("known", nil, nil)
+	doc := "{\"states\": [{\"name\": \"a\",\n\"parent\": \"ghost\",\n\"transitions\": [{\"from\": \"known\", \"text\": \"a\"},\n{\"from\": \"b\", \"text\": \"a\"}]}]}"
+	_, err := LoadDefinition(f, strings.NewReader(doc), testRegistry())
+	expect := "Invalid state definition: line 2: Parent state ghost is not defined.; line 4: State b is not defined."
+	if err == nil || err.Error() != expect {
+		t.Errorf("Expected error %q, got %v", expect, err)
+	}
+	if _, ok := f.State("a"); ok {
+		t.Errorf("Expected nothing registered on error")
+	}
+
+	f.AddSubflow(Subflow{"flow", "entry", []StateMaker{flowState{"entry", nil, nil}}})
+	doc = "{\"states\": [{\"name\": \"a\"},\n{\"name\": \"flow\"}]}"
+	_, err = LoadDefinition(f, strings.NewReader(doc), testRegistry())
+	expect = "Invalid state definition: line 2: State flow is used as subflow name."
+	if err == nil || err.Error() != expect {
+		t.Errorf("Expected error %q, got %v", expect, err)
+	}
+	if _, ok := f.State("a"); ok {
+		t.Errorf("Expected nothing registered when colliding with subflow")
+	}
+}
+
+const testYAMLDefinition = `# same as testDefinition
+states:
+  - name: &menu menu
+    enter: greet
+    transitions:
+      - from: ""
+        command: /start
+        desc: >-
+          greet
+      - global: true
+        command: '/menu'
+
+  - name: number
+    parent: *menu
+    error_state: *menu
+    on_error: sorry # comment
+    transitions:
+    - from: menu
+      regexp: "^(\\d+)$"
+      guard: isAdmin
+    - {from: menu, timeout: 1m}
+  - name: echo
+    unrecorded: true
+    transitions: [{from: menu, type: TEXT, transitor: toEcho}]
+`
+
+func TestYAMLDefinition(t *testing.T) {
+	expect, err := ParseDefinition(strings.NewReader(testDefinition), testRegistry())
+	if err != nil {
+		t.Fatalf("Cannot parse JSON definition: %s", err)
+	}
+	actual, err := ParseDefinition(strings.NewReader(testYAMLDefinition), testRegistry())
+	if err != nil {
+		t.Fatalf("Cannot parse YAML definition: %s", err)
+	}
+	if len(actual) != len(expect) {
+		t.Fatalf("Expected %d states, got %d", len(expect), len(actual))
+	}
+	for i := range expect {
+		e, a := expect[i].(*definedState), actual[i].(*definedState)
+		if a.name != e.name || a.parent != e.parent || a.errorState != e.errorState || a.unrecorded != e.unrecorded || (a.enter == nil) != (e.enter == nil) || (a.onError == nil) != (e.onError == nil) || len(a.trans) != len(e.trans) {
+			t.Errorf("Expected state %+v, got %+v", e, a)
+			continue
+		}
+		for j := range e.trans {
+			et, at := e.trans[j], a.trans[j]
+			if et.Match != nil && (at.Match == nil || at.Match.String() != et.Match.String()) {
+				t.Errorf("Expected matcher %s of state[%s], got %v", et.Match, e.name, at.Match)
+			}
+			et.Match, at.Match, et.Transitor, at.Transitor = nil, nil, nil, nil
+			if fmt.Sprintf("%+v", at) != fmt.Sprintf("%+v", et) {
+				t.Errorf("Expected transition %+v of state[%s], got %+v", et, e.name, at)
+			}
+		}
+	}
+}
+
+func TestYAMLDefinitionErrors(t *testing.T) {
+	cases := []struct {
+		doc    string
+		expect string
+	}{
+		{"states:\n  - name: 1\n", "line 2: Expected string for states.0.name, got number."},
+		{"states:\n  - name: a\n\n    gurad: x\n", "line 4: Unknown field gurad."},
+		{"states:\n  - name: a\n    transitions:\n      - from: ''\n        timeout: soon\n", "line 5: Invalid timeout \"soon\"."},
+		{"states:\n  - name: a\n  - name: a\n", "line 3: State a is already defined at line 2."},
+		{"states:\n  - name: a\n    name: b\n", "line 3: Duplicate key name."},
+		{"states:\n  - name: a\n    enter: b: c\n", "line 3: mapping values are not allowed in this context"},
+		{"states:\n  - name: \"a\n", "line 2: found unexpected end of stream"},
+	}
+	for _, c := range cases {
+		_, err := ParseDefinition(strings.NewReader(c.doc), testRegistry())
+		if _, ok := err.(DefinitionErrors); !ok || !strings.Contains(err.Error(), c.expect) {
+			t.Errorf("Expected error %q for %q, got %v", c.expect, c.doc, err)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"strconv"
+	"strings"
+)
+
+// diagram holds what Mermaid and PlantUML renderers share: both declare states
+// by alias, nest states of a group inside the parent state, and nest states of
+// a subflow inside a pseudo state.
+type diagram struct {
+	g       *Graph
+	aliases map[string]string
+	nested  map[string]bool // states declared in composite states
+	buf     strings.Builder
+}
+
+func newDiagram(g *Graph) *diagram {
+	d := &diagram{
+		g:       g,
+		aliases: map[string]string{AnyState: "any"},
+		nested:  make(map[string]bool),
+	}
+	for i, st := range g.States {
+		d.aliases[st.ID] = "s" + strconv.Itoa(i)
+	}
+	return d
+}
+
+// name returns display name of state id, quoted by double quotes.
+func (d *diagram) name(id string) string {
+	if id == AnyState {
+		return `"any state"`
+	}
+	return `"` + strings.Replace(d.g.Display(id), `"`, `'`, -1) + `"`
+}
+
+func (d *diagram) line(indent int, s string) {
+	d.buf.WriteString(strings.Repeat("    ", indent) + s + "\n")
+}
+
+// composites writes clusters as composite states by calling declare for each
+// state and open for each composite, which returns how to close it.
+func (d *diagram) composites(cs []*cluster, indent int, declare func(id string, indent int), open func(c *cluster, alias string, indent int) string) {
+	for i, c := range cs {
+		alias := d.aliases[c.state]
+		if c.state == "" {
+			alias = "flow" + strconv.Itoa(i)
+		}
+		end := open(c, alias, indent)
+		for _, id := range c.states {
+			declare(id, indent+1)
+		}
+		d.composites(c.children, indent+1, declare, open)
+		d.line(indent, end)
+	}
+}
+
+func (d *diagram) markNested(cs []*cluster) {
+	for _, c := range cs {
+		d.nested[c.state] = c.state != ""
+		for _, id := range c.states {
+			d.nested[id] = true
+		}
+		d.markNested(c.children)
+	}
+}
+
+// hasGlobal reports whether any edge starts from AnyState.
+func (d *diagram) hasGlobal() bool {
+	for _, e := range d.g.Edges {
+		if e.From == AnyState {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *diagram) label(e GraphEdge, sep string) string {
+	lines := e.Lines()
+	if e.Kind == HiddenEdge {
+		lines = append([]string{"(Transit)"}, lines...)
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return " : " + strings.Join(lines, sep)
+}
+
+type mermaidRenderer struct{}
+
+// Render renders g as Mermaid stateDiagram-v2.
+func (mermaidRenderer) Render(g *Graph) string {
+	d := newDiagram(g)
+	cs := clusters(g)
+	d.line(0, "stateDiagram-v2")
+	d.line(1, "classDef undocumented fill:#f66")
+	for _, st := range g.States {
+		alias := d.aliases[st.ID]
+		d.line(1, "state "+d.name(st.ID)+" as "+alias)
+		if st.Enter {
+			d.line(1, alias+" : enter action")
+		}
+		if st.Leave {
+			d.line(1, alias+" : leave action")
+		}
+		if st.Undocumented {
+			d.line(1, "class "+alias+" undocumented")
+		}
+	}
+	if d.hasGlobal() {
+		d.line(1, "state "+d.name(AnyState)+" as any")
+	}
+	d.composites(cs, 1, func(id string, indent int) {
+		d.line(indent, d.aliases[id])
+	}, func(c *cluster, alias string, indent int) string {
+		if c.state == "" {
+			d.line(indent, "state "+d.name(c.label)+" as "+alias+" {")
+		} else {
+			d.line(indent, "state "+alias+" {")
+		}
+		return "}"
+	})
+
+	d.line(1, "[*] --> "+d.aliases[InitialState])
+	for _, e := range g.Edges {
+		d.line(1, d.aliases[e.From]+" --> "+d.aliases[e.To]+d.label(e, ", "))
+	}
+	return d.buf.String()
+}
+
+type plantUMLRenderer struct{}
+
+// Render renders g as PlantUML state diagram.
+func (plantUMLRenderer) Render(g *Graph) string {
+	d := newDiagram(g)
+	cs := clusters(g)
+	d.markNested(cs)
+	states := make(map[string]GraphState)
+	for _, st := range g.States {
+		states[st.ID] = st
+	}
+	declare := func(id string, indent int) {
+		st := states[id]
+		alias := d.aliases[id]
+		decl := "state " + d.name(id) + " as " + alias
+		if st.Undocumented {
+			decl += " #red"
+		}
+		d.line(indent, decl)
+		if st.Enter {
+			d.line(indent, alias+" : enter action")
+		}
+		if st.Leave {
+			d.line(indent, alias+" : leave action")
+		}
+	}
+
+	d.line(0, "@startuml")
+	for _, st := range g.States {
+		if !d.nested[st.ID] {
+			declare(st.ID, 0)
+		}
+	}
+	if d.hasGlobal() {
+		d.line(0, "state "+d.name(AnyState)+" as any")
+	}
+	d.composites(cs, 0, declare, func(c *cluster, alias string, indent int) string {
+		if c.state == "" {
+			d.line(indent, "state "+d.name(c.label)+" as "+alias+" {")
+			return "}"
+		}
+		declare(c.state, indent)
+		d.line(indent, "state "+alias+" {")
+		return "}"
+	})
+
+	d.line(0, "[*] --> "+d.aliases[InitialState])
+	for _, e := range g.Edges {
+		arrow := " --> "
+		switch e.Kind {
+		case HiddenEdge:
+			arrow = " -[dotted]-> "
+		case TimeoutEdge, ReturnEdge:
+			arrow = " -[dashed]-> "
+		case ErrorEdge:
+			arrow = " -[#red]-> "
+		}
+		d.line(0, d.aliases[e.From]+arrow+d.aliases[e.To]+d.label(e, `\n`))
+	}
+	d.line(0, "@enduml")
+	return d.buf.String()
+}
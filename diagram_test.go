@@ -0,0 +1,144 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Patrolavia/telegram"
+)
+
+type diagramState struct {
+	nestedState
+	errorState string
+}
+
+func (s diagramState) ErrorRecovery() (ErrorHandler, string) { return nil, s.errorState }
+
+func makeDiagramFSM() FSM {
+	f := NewBySender(nil, MemoryStore(nil), 1, make(chan *telegram.Message))
+	action := func(msg *telegram.Message, current State, api telegram.API) error { return nil }
+	f.MakeState(nestedState{"menu", "", action, nil, []TransitorMap{
+		{State: InitialState, Type: TextMsg, Command: "/start", Desc: "greet"},
+		{State: "sorry", IsHidden: true},
+	}})
+	f.MakeState(nestedState{"checkout", "", nil, action, nil})
+	f.MakeState(diagramState{nestedState{"checkout.pay", "checkout", nil, nil, []TransitorMap{
+		{State: "menu", Type: TextMsg, Match: Text("pay")},
+		{State: "menu", Timeout: time.Minute},
+		{State: "menu", Call: "phone"},
+	}}, "sorry"})
+	f.MakeState(nestedState{"sorry", "", nil, nil, []TransitorMap{
+		{IsGlobal: true, Type: TextMsg, Command: "/cancel"},
+	}})
+	f.AddSubflow(Subflow{"phone", "phone.ask", []StateMaker{
+		nestedState{"phone.ask", "", nil, nil, []TransitorMap{{State: "ghost", IsFallback: true}}},
+	}})
+	return f
+}
+
+func TestGraphvizGlobalCluster(t *testing.T) {
+	dot := makeDiagramFSM().StateMap("start")
+	if !strings.Contains(dot, `subgraph "cluster_global"`) {
+		t.Errorf("Expected global transitors drawn as a cluster, got %s", dot)
+	}
+}
+
+func TestGraphvizQuoting(t *testing.T) {
+	g := &Graph{Initial: "start", States: []GraphState{
+		{ID: InitialState},
+		{ID: "a\nb"},
+		{ID: `say "hi"\`, Parent: "a\nb"},
+	}, Edges: []GraphEdge{
+		{From: InitialState, To: `say "hi"\`, Kind: FallbackEdge, Desc: `"\`},
+	}}
+	dot := Graphviz.Render(g)
+	for _, expect := range []string{
+		`"say \"hi\"\\" [label="say \"hi\"\\"];`,
+		`"start" -> "say \"hi\"\\" [label="\"\\\nfallback"];`,
+		`subgraph "cluster_a\nb" {`,
+	} {
+		if !strings.Contains(dot, expect) {
+			t.Errorf("Expected %s in:\n%s", expect, dot)
+		}
+	}
+	if !strings.HasSuffix(dot, "\t}\n}\n") {
+		t.Errorf("Expected clusters inside the graph, got:\n%s", dot)
+	}
+}
+
+func TestGraph(t *testing.T) {
+	g := makeDiagramFSM().Graph("start")
+	var ids []string
+	for _, st := range g.States {
+		ids = append(ids, st.ID)
+	}
+	expect := ",checkout,checkout.pay,ghost,menu,phone.ask,sorry"
+	if actual := strings.Join(ids, ","); actual != expect {
+		t.Errorf("Expected states %s, got %s", expect, actual)
+	}
+	if g.States[3].ID != "ghost" || !g.States[3].Undocumented || g.States[5].Flow != "phone" || g.States[2].Parent != "checkout" {
+		t.Errorf("Unexpected states %+v", g.States)
+	}
+
+	var edges []string
+	for _, e := range g.Edges {
+		edges = append(edges, g.Display(e.From)+">"+g.Display(e.To)+":"+strings.Join(e.Lines(), "|"))
+	}
+	expectEdges := []string{
+		"start>menu:greet|Command: /start",
+		"*>sorry:Command: /cancel",
+		"checkout.pay>sorry:on error",
+		"ghost>phone.ask:fallback",
+		"menu>checkout.pay:timeout: 1m0s",
+		"menu>checkout.pay:TEXT|text == \"pay\"",
+		"menu>phone.ask:call: phone",
+		"menu>sorry:",
+		"phone.ask>checkout.pay:return: phone",
+	}
+	if strings.Join(edges, "\n") != strings.Join(expectEdges, "\n") {
+		t.Errorf("Unexpected edges:\n%s", strings.Join(edges, "\n"))
+	}
+}
+
+func TestMermaid(t *testing.T) {
+	out := makeDiagramFSM().RenderStateMap("start", Mermaid)
+	for _, line := range []string{
+		"stateDiagram-v2",
+		`    state "start" as s0`,
+		"    s1 : leave action",
+		"    class s3 undocumented",
+		"    state s1 {\n        s2\n    }",
+		"    state \"subflow: phone\" as flow1 {\n        s5\n    }",
+		"    [*] --> s0",
+		"    any --> s6 : Command: /cancel",
+		"    s4 --> s6 : (Transit)",
+		"    s4 --> s2 : TEXT, text == \"pay\"",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Expected %q in Mermaid diagram:\n%s", line, out)
+		}
+	}
+}
+
+func TestPlantUML(t *testing.T) {
+	out := makeDiagramFSM().RenderStateMap("start", PlantUML)
+	for _, line := range []string{
+		"@startuml",
+		`state "ghost" as s3 #red`,
+		"state \"checkout\" as s1\ns1 : leave action\nstate s1 {\n    state \"checkout.pay\" as s2\n}",
+		"state \"subflow: phone\" as flow1 {\n    state \"phone.ask\" as s5\n}",
+		`s4 -[dotted]-> s6 : (Transit)`,
+		`s4 -[dashed]-> s2 : timeout: 1m0s`,
+		`s2 -[#red]-> s6 : on error`,
+		`s0 --> s4 : greet\nCommand: /start`,
+		"@enduml",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Expected %q in PlantUML diagram:\n%s", line, out)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+type fileStore struct {
+	dir   string
+	codec Codec
+	init  StateInitializer
+}
+
+// FileStore provides a durable SaveLoader, storing state of each user in its own
+// file under dir. Files are replaced atomically, so a crash never leaves a
+// half-written state.
+//
+// It creates dir if not exist. It also implements TimerStore, storing timers in
+// the "timers" subdirectory.
+func FileStore(dir string, codec Codec, init StateInitializer) (SaveLoader, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "timers"), 0700); err != nil {
+		return nil, err
+	}
+	return &fileStore{dir, codec, init}, nil
+}
+
+func (s *fileStore) path(uid string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(uid)))
+}
+
+// subPath returns path of the file of user in subdirectory sub.
+func (s *fileStore) subPath(sub, uid string) string {
+	return filepath.Join(s.dir, sub, hex.EncodeToString([]byte(uid)))
+}
+
+// writeFile writes atomically by renaming a fully-written temporary file.
+func (s *fileStore) writeFile(fn string, write func(f *os.File) error) (err error) {
+	f, err := os.CreateTemp(s.dir, ".tmp-")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+
+	if err = write(f); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return
+	}
+	return os.Rename(f.Name(), fn)
+}
+
+func (s *fileStore) Save(uid string, sid string, data interface{}) error {
+	return s.writeFile(s.path(uid), func(f *os.File) error {
+		return s.codec.Encode(f, sid, data)
+	})
+}
+
+func (s *fileStore) Load(uid string) (sid string, data interface{}, err error) {
+	f, err := os.Open(s.path(uid))
+	if os.IsNotExist(err) {
+		return InitialState, s.init(uid), nil
+	}
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	return s.codec.Decode(f)
+}
+
+// saveJSON writes v as JSON to file of user in subdirectory sub.
+func (s *fileStore) saveJSON(sub, uid string, v interface{}) error {
+	return s.writeFile(s.subPath(sub, uid), func(f *os.File) error {
+		return json.NewEncoder(f).Encode(v)
+	})
+}
+
+// loadJSON reads JSON file of user in subdirectory sub into v, leaving v untouched if not exist.
+func (s *fileStore) loadJSON(sub, uid string, v interface{}) error {
+	data, err := os.ReadFile(s.subPath(sub, uid))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (s *fileStore) SaveTimer(uid string, t Timer) error {
+	return s.saveJSON("timers", uid, t)
+}
+
+func (s *fileStore) DeleteTimer(uid string) error {
+	err := os.Remove(s.subPath("timers", uid))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// ClaimTimer is not atomic across processes, a directory should not be shared
+// by several FSMs anyway.
+func (s *fileStore) ClaimTimer(uid string, t Timer) (bool, error) {
+	var saved Timer
+	if err := s.loadJSON("timers", uid, &saved); err != nil || saved.User == nil {
+		return false, err
+	}
+	if saved.From != t.From || saved.To != t.To || !saved.Deadline.Equal(t.Deadline) {
+		return false, nil
+	}
+	if err := s.DeleteTimer(uid); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *fileStore) LoadTimers() (ret []Timer, err error) {
+	dir := filepath.Join(s.dir, "timers")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var t Timer
+		if err = json.Unmarshal(data, &t); err != nil {
+			return nil, err
+		}
+		ret = append(ret, t)
+	}
+	return
+}
@@ -0,0 +1,71 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import "testing"
+
+type testFormData struct {
+	Name  string
+	Items []string
+}
+
+func testFileStoreRoundTrip(t *testing.T, name string, codec func() Codec) {
+	dir := t.TempDir()
+	init := func(uid string) interface{} { return testFormData{} }
+	codec1 := codec()
+	codec1.Register(testFormData{})
+	store, err := FileStore(dir, codec1, init)
+	if err != nil {
+		t.Fatalf("%s: cannot create file store: %s", name, err)
+	}
+
+	if sid, data, err := store.Load("@user"); err != nil || sid != InitialState || data.(testFormData).Name != "" {
+		t.Errorf("%s: expected initial state for new user, got state[%s] with data %v, err %v", name, sid, data, err)
+	}
+
+	expect := testFormData{"test", []string{"a", "b"}}
+	if err := store.Save("@user", "state", expect); err != nil {
+		t.Fatalf("%s: cannot save: %s", name, err)
+	}
+	if err := store.Save("other", "other", nil); err != nil {
+		t.Fatalf("%s: cannot save nil data: %s", name, err)
+	}
+
+	// simulate restart
+	codec2 := codec()
+	codec2.Register(testFormData{})
+	store, _ = FileStore(dir, codec2, init)
+	sid, data, err := store.Load("@user")
+	if err != nil {
+		t.Fatalf("%s: cannot load: %s", name, err)
+	}
+	actual, ok := data.(testFormData)
+	if sid != "state" || !ok || actual.Name != expect.Name || len(actual.Items) != 2 || actual.Items[1] != "b" {
+		t.Errorf("%s: data does not round-trip, got state[%s] with data %#v", name, sid, data)
+	}
+	if sid, data, err := store.Load("other"); err != nil || sid != "other" || data != nil {
+		t.Errorf("%s: nil data does not round-trip, got state[%s] with data %#v, err %v", name, sid, data, err)
+	}
+
+	if err := store.Save("@user", "state", Record{expect, []string{"prev"}, []Frame{{"flow", "ret"}}}); err != nil {
+		t.Fatalf("%s: cannot save record: %s", name, err)
+	}
+	_, data, err = store.Load("@user")
+	r, ok := data.(Record)
+	if err != nil || !ok || r.Data.(testFormData).Name != expect.Name || len(r.History) != 1 || r.Calls[0] != (Frame{"flow", "ret"}) {
+		t.Errorf("%s: record does not round-trip, got %#v, err %v", name, data, err)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	testFileStoreRoundTrip(t, "json", JSONCodec)
+	testFileStoreRoundTrip(t, "gob", GobCodec)
+}
+
+func TestJSONCodecUnregistered(t *testing.T) {
+	store, _ := FileStore(t.TempDir(), JSONCodec(), func(uid string) interface{} { return nil })
+	if err := store.Save("user", "state", testFormData{}); err == nil {
+		t.Errorf("Saving unregistered type should fail.")
+	}
+}
@@ -4,18 +4,77 @@
 package botgoram
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
 
 	"github.com/Patrolavia/telegram"
 )
 
-// ErrStateNotFound tells you if no such state name was registered in fsm.
+// ErrStateNotFound tells you if no such state name was registered in fsm. It
+// might be wrapped with more details, use errors.Is to test it.
 var ErrStateNotFound = errors.New("State not found.")
 
+// errStopped is returned by worker when there is no more message to process after Stop.
+var errStopped = errors.New("FSM stopped.")
+
 // Action describes what to do when enter/leaving a state.
 type Action func(msg *telegram.Message, current State, api telegram.API) error
 
+// UpdateKind denotes what triggers processing of an Update.
+type UpdateKind int
+
+// Kinds of Update.
+const (
+	UpdateMessage  UpdateKind = iota // a new message
+	UpdateEdited                     // an edited message
+	UpdateCallback                   // a callback query
+	UpdateTimeout                    // a timeout registered by State.RegisterTimeout
+)
+
+// Update describes what a Handler processes.
+//
+// For callback queries, Message is a copy of the message the query originated
+// from, with sender replaced by who pressed the button. For timeouts, Message is
+// an empty message from the user.
+type Update struct {
+	Kind    UpdateKind
+	Message *telegram.Message
+	Query   *telegram.CallbackQuery // only for UpdateCallback
+	Timer   *Timer                  // only for UpdateTimeout
+}
+
+// Handler processes an update with current state of the user: tests transitors,
+// transits and saves. It returns state of the user after processing.
+type Handler func(u Update, current State, api telegram.API) (next State, err error)
+
+// Middleware wraps message processing, like logging, authorization or rate limiting.
+//
+// State of the user is loaded before middlewares are called, which are called
+// in the order of registration, the innermost Handler tests transitors, transits
+// and saves state. A middleware can short-circuit by returning without calling
+// next, the message is considered processed if err is nil. It can also observe
+// the result or error returned by next, like *ConflictError before the message
+// is retried.
+type Middleware func(next Handler) Handler
+
+// ErrorHandler handles error returned by enter/leave action of current state,
+// like telling user something goes wrong.
+//
+// Returning nil means the error is recovered: user is transited to the error
+// state, or stays in the state before transition if there is no error state. The
+// enter action of error state receives data from current state, so you can modify
+// it here. Returning an error fails the message as usual.
+type ErrorHandler func(msg *telegram.Message, current State, err error, api telegram.API) error
+
+// CallbackAnswerer answers callback query q, which has been processed with err
+// (nil if succeeded), or dropped by retry policy with the last error.
+type CallbackAnswerer func(q *telegram.CallbackQuery, err error, api telegram.API)
+
 // FSM is a finite state machine.
 type FSM interface {
 	// Start will "power on" the FSM.
@@ -23,7 +82,15 @@ type FSM interface {
 	// At the mean time, other worker will stay working.
 	Start(timeout int) error
 	// Resume the stopped worker. Calling Resume will block until any worker goes wrong.
+	// Start and Resume return nil after Stop finishes.
 	Resume() error
+	// Stop gracefully shuts down the FSM: stop receiving new messages, wait
+	// queued and in-flight messages to be processed (transit and save), then
+	// return. It returns ctx.Err() if ctx expires before all messages are done.
+	// The default long-polling fetcher stops after its current request, messages
+	// fetched by it are processed before Stop returns. Messages left by workers
+	// stopped by error are not waited.
+	Stop(ctx context.Context) error
 	AddState(id string, enter, leave Action) (State, error)
 	State(id string) (State, bool)
 	// MakeState will register a new state with StateMaker.
@@ -31,6 +98,72 @@ type FSM interface {
 	MakeState(StateMaker) (State, error)
 	// StateMap generate graphviz diagram from registered StateMaker
 	StateMap(name string) (dot string)
+	// Graph describes the state map declared by StateMakers, with InitialState named name.
+	Graph(name string) *Graph
+	// RenderStateMap renders state map using r, like Mermaid or PlantUML.
+	RenderStateMap(name string, r Renderer) string
+	// CallbackQueries sets the channel to read callback queries from. Call it before Start.
+	// The default long-polling fetcher does not fetch callback queries, you have to
+	// provide your own message channel and fetcher to use this.
+	CallbackQueries(queries chan *telegram.CallbackQuery)
+	// AnswerCallbacks sets the hook to answer callback queries, called once for
+	// each query. Telegram clients show progress on the button until the query
+	// is answered. Call it before Start.
+	AnswerCallbacks(a CallbackAnswerer)
+	// DisableLongPolling disables the default long-polling fetcher created by
+	// passing nil message channel, e.g. when receiving updates by NewWebhook.
+	// Call it before Start.
+	DisableLongPolling()
+	// EditedMessages sets the channel to read edited messages from. Call it before Start.
+	// Like CallbackQueries, the default long-polling fetcher ignores edited messages.
+	EditedMessages(msgs chan *telegram.Message)
+	// SetRetryPolicy sets how to deal with failed message. Call it before Start.
+	//
+	// By default, the worker processing failed message stops, and the message will
+	// be processed again after Resume. With retry policy, worker keeps working, retries
+	// the message as policy says, and then drops it to dead letter sink.
+	SetRetryPolicy(p RetryPolicy)
+	// SetBackoff sets how long to wait before retrying a message, defaults to
+	// ExponentialBackoff(100*time.Millisecond, 30*time.Second), nil retries
+	// immediately. Later messages of the user wait too, other users are not
+	// affected. Messages retried for ConflictError back off too, counted apart
+	// from failures. Call it before Start.
+	SetBackoff(b Backoff)
+	// SetDeadLetter sets the sink of messages dropped by retry policy. Without it,
+	// worker stops and returns the error when dropping a message.
+	SetDeadLetter(d DeadLetter)
+	// Use appends middlewares to the chain. Call it before Start.
+	Use(mw ...Middleware)
+
+	// Global transitors are matched in every state, like /cancel or /help.
+	// They apply to messages, but not callback queries or edited messages.
+	// The state passed to global transitors is current state of the user.
+	RegisterGlobal(mt string, t Transitor)
+	RegisterGlobalCommand(cmd string, t Transitor)
+	RegisterGlobalFallback(t Transitor)
+	// SetGlobalPrecedence sets when to match global transitors, defaults to GlobalCommandFirst.
+	SetGlobalPrecedence(p GlobalPrecedence)
+	// SetHistoryDepth enables state history, keeping at most n states for each user.
+	// History is saved with state data, see Record and State.History.
+	SetHistoryDepth(n int)
+	// AddSubflow registers states of a subflow, so it can be called by State.Call.
+	// Pending calls are saved with state data, see Record.
+	AddSubflow(flow Subflow) error
+	// Subflow returns the subflow added by AddSubflow.
+	Subflow(name string) (Subflow, bool)
+	// SetCommandParser sets how to parse commands, see CommandParser.
+	// It must be called before Start.
+	SetCommandParser(p CommandParser)
+
+	// Validate analyzes the state map declared by StateMakers, see Report.
+	// Start validates automatically, logging the issues or passing them to the
+	// handler set by OnReport, or returning the Report in strict mode.
+	Validate() Report
+	// SetStrict sets whether Start returns error when Validate reports any issue.
+	SetStrict(strict bool)
+	// OnReport sets what to do with issues found when Start in non-strict mode.
+	// Issues are logged if not set.
+	OnReport(h func(r Report))
 }
 
 func bySender(msg *telegram.Message) *telegram.Victim {
@@ -55,21 +188,35 @@ type fsm struct {
 	manager       *manager
 	errorChannel  chan error
 	sm            []StateMaker
+	pending       []StateMaker // StateMakers with transitors not registered yet
+	stopped       chan struct{}
+	stopOnce      sync.Once
+	timers        *scheduler
+	retry         RetryPolicy
+	deadLetter    DeadLetter
+	middlewares   []Middleware
+	global        *state
+	precedence    GlobalPrecedence
+	historyDepth  int
+	flows         map[string]Subflow
+	parser        CommandParser
+	prepareLock   sync.Mutex
+	prepared      int // number of prepare steps done
+	strict        bool
+	reporter      func(Report)
+	fetcher       *telegram.LongPollFetcher
+	answerer      CallbackAnswerer
+	backoff       Backoff
 }
 
 func newFSM(api telegram.API, ue func(*telegram.Message) *telegram.Victim, sl SaveLoader, size int, msgs chan *telegram.Message) (ret FSM) {
+	var lp *telegram.LongPollFetcher
 	if msgs == nil {
 		msgs = make(chan *telegram.Message)
-		lp := &telegram.LongPollFetcher{
+		lp = &telegram.LongPollFetcher{
 			Message: msgs,
 			API:     api,
 		}
-
-		go func(lp *telegram.LongPollFetcher) {
-			for {
-				lp.Fetch(size, 30) // just retry if error occurs
-			}
-		}(lp)
 	}
 	tmp := &fsm{
 		api, ue, map[string]internalStateData{
@@ -77,7 +224,30 @@ func newFSM(api telegram.API, ue func(*telegram.Message) *telegram.Victim, sl Sa
 		}, sl, newManager(ue, size, msgs),
 		make(chan error, size),
 		make([]StateMaker, 0),
+		make([]StateMaker, 0),
+		make(chan struct{}),
+		sync.Once{},
+		nil,
+		nil,
+		nil,
+		nil,
+		newState(InitialState).(*state),
+		GlobalCommandFirst,
+		0,
+		make(map[string]Subflow),
+		CommandParser{},
+		sync.Mutex{},
+		0,
+		false,
+		nil,
+		lp,
+		nil,
+		ExponentialBackoff(100*time.Millisecond, 30*time.Second),
 	}
+	tmp.timers = newScheduler(func(t *Timer) {
+		tmp.manager.inject(timeoutUpdate(t))
+	})
+	tmp.manager.drain = lp != nil
 	for i := 0; i < size; i++ {
 		tmp.errorChannel <- nil
 	}
@@ -103,13 +273,34 @@ func NewByChat(api telegram.API, sl SaveLoader, size int, msgs chan *telegram.Me
 	return newFSM(api, byChat, sl, size, msgs)
 }
 
+// unwrap returns the StateMaker or SaveLoader user provides, which might
+// implement optional interfaces.
+func unwrap(v interface{}) interface{} {
+	if w, ok := v.(interface {
+		unwrap() interface{}
+	}); ok {
+		return w.unwrap()
+	}
+	return v
+}
+
 func (f *fsm) MakeState(sm StateMaker) (ret State, err error) {
 	enter, leave := sm.Actions()
 	if ret, err = f.AddState(sm.Name(), enter, leave); err != nil {
 		return
 	}
+	if r, ok := unwrap(sm).(ErrorRecoverer); ok {
+		ret.OnError(r.ErrorRecovery())
+	}
+	if n, ok := unwrap(sm).(Nested); ok {
+		ret.SetParent(n.Parent())
+	}
+	if u, ok := unwrap(sm).(Unrecorded); ok && u.Unrecorded() {
+		ret.DisableHistory()
+	}
 
 	f.sm = append(f.sm, sm)
+	f.pending = append(f.pending, sm)
 	return
 }
 
@@ -117,6 +308,9 @@ func (f *fsm) AddState(id string, enter, leave Action) (ret State, err error) {
 	if _, ok := f.states[id]; ok {
 		return ret, fmt.Errorf("State id %s is in use.", id)
 	}
+	if _, ok := f.flows[id]; ok {
+		return ret, fmt.Errorf("State id %s is used as subflow name.", id)
+	}
 
 	ret = newState(id)
 	f.states[id] = internalStateData{ret, enter, leave}
@@ -131,72 +325,275 @@ func (f *fsm) State(id string) (ret State, ok bool) {
 	return
 }
 
-// register statemaker's transitors
+// register statemaker's transitors, nothing is registered if any state is not found.
+// f.sm is kept for Graph and Validate.
 func (f *fsm) registerStateMapTransitors() error {
-	for _, s := range f.sm {
+	type pending struct {
+		st   State
+		name string
+		t    TransitorMap
+	}
+	var ps []pending
+	for _, s := range f.pending {
 		for _, t := range s.Transitors() {
 			if t.IsHidden {
 				continue
 			}
-			st, ok := f.State(t.State)
-			if !ok {
-				return ErrStateNotFound
+			var st State = f.global
+			if !t.IsGlobal {
+				var ok bool
+				if st, ok = f.State(t.State); !ok {
+					return fmt.Errorf("Cannot find state[%s] having transitor to state[%s]: %w", t.State, s.Name(), ErrStateNotFound)
+				}
 			}
-			switch {
-			case t.IsFallback:
+			ps = append(ps, pending{st, s.Name(), t})
+		}
+	}
+
+	for _, p := range ps {
+		st, t := p.st, p.t
+		if t.Transitor == nil && t.Match != nil {
+			t.Transitor = matchTransitor(t.Match, p.name)
+		}
+		if t.Call != "" {
+			t.Transitor = callTransitor(t.Transitor, t.Call, p.name)
+		}
+		switch {
+		case t.Timeout > 0:
+			st.RegisterTimeout(t.Timeout, p.name)
+		case t.IsFallback:
+			st.RegisterFallback(t.Transitor)
+		case t.IsCallback:
+			st.RegisterCallback(t.Callback, t.Transitor)
+		case t.IsEdited:
+			st.RegisterEdited(t.Transitor)
+		case t.IsForward:
+			st.RegisterForward(t.Transitor)
+		case t.IsReply:
+			st.RegisterReply(t.Transitor)
+		case t.Command != "" && t.Type == TextMsg:
+			st.RegisterCommand(t.Command, t.Transitor)
+		case t.Type == "" && t.Match != nil:
+			if r, ok := t.Match.(registerer); ok {
+				r.register(st, t.Transitor)
+			} else {
 				st.RegisterFallback(t.Transitor)
-			case t.Command != "" && t.Type == TextMsg:
-				st.RegisterCommand(t.Command, t.Transitor)
-			default:
-				st.Register(t.Type, t.Transitor)
 			}
+		default:
+			st.Register(t.Type, t.Transitor)
+		}
+	}
+	f.pending = []StateMaker{}
+	return nil
+}
+
+func (f *fsm) CallbackQueries(queries chan *telegram.CallbackQuery) {
+	f.manager.setSources(queries, nil)
+}
+
+func (f *fsm) AnswerCallbacks(a CallbackAnswerer) {
+	f.answerer = a
+}
+
+func (f *fsm) EditedMessages(msgs chan *telegram.Message) {
+	f.manager.setSources(nil, msgs)
+}
+
+func (f *fsm) SetRetryPolicy(p RetryPolicy) {
+	f.retry = p
+}
+
+func (f *fsm) SetBackoff(b Backoff) {
+	f.backoff = b
+}
+
+func (f *fsm) SetDeadLetter(d DeadLetter) {
+	f.deadLetter = d
+}
+
+func (f *fsm) Use(mw ...Middleware) {
+	f.middlewares = append(f.middlewares, mw...)
+}
+
+func (f *fsm) DisableLongPolling() {
+	f.fetcher = nil
+	f.manager.drain = false
+}
+
+// prepare registers transitors of StateMakers and checks settings. Steps done
+// are not repeated, and a failed step is retried by next call.
+func (f *fsm) prepare() error {
+	f.prepareLock.Lock()
+	defer f.prepareLock.Unlock()
+	steps := []func() error{
+		f.validate,
+		f.registerStateMapTransitors,
+		f.checkGroups,
+	}
+	for ; f.prepared < len(steps); f.prepared++ {
+		if err := steps[f.prepared](); err != nil {
+			return err
 		}
 	}
-	f.sm = []StateMaker{}
 	return nil
 }
 
 func (f *fsm) Start(timeout int) error {
-	if err := f.registerStateMapTransitors(); err != nil {
+	if err := f.prepare(); err != nil {
+		return err
+	}
+	if err := f.loadTimers(); err != nil {
 		return err
 	}
+	f.learnBotName()
 
 	// start message manager
 	go f.manager.Run()
+	if f.fetcher != nil {
+		go f.poll()
+	}
 
 	// start worker goroutines
 	return f.Resume()
 }
 
 func (f *fsm) Resume() error {
-	for err := range f.errorChannel {
-		if err != nil {
-			return err
+	for {
+		select {
+		case <-f.stopped:
+			return nil
+		case err := <-f.errorChannel:
+			if err == errStopped {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			go func() {
+				err := f.work()
+				if err != nil && err != errStopped {
+					// retired now, errors might stay in errorChannel until next Resume
+					f.manager.retire()
+				}
+				f.errorChannel <- err
+			}()
 		}
-		go func() { f.errorChannel <- f.work() }()
 	}
-	return nil
+}
+
+// poll runs the default long-polling fetcher until Stop. Updates fetched by the
+// last request are still queued, since the offset has been advanced.
+func (f *fsm) poll() {
+	defer close(f.fetcher.Message)
+	for !f.manager.isClosed() {
+		f.fetcher.Fetch(f.manager.size, 30) // just retry if error occurs
+	}
+}
+
+func (f *fsm) Stop(ctx context.Context) error {
+	f.manager.Close()
+
+	done := make(chan struct{})
+	go func() {
+		f.manager.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	f.timers.stop()
+	f.stopOnce.Do(func() { close(f.stopped) })
+	return err
 }
 
 func (f *fsm) work() (err error) {
-	msg := f.manager.Begin()
-	defer f.manager.Rollback(msg)
+	u := f.manager.Begin()
+	if u == nil {
+		return errStopped
+	}
+	defer f.manager.Rollback(u)
 
-	user := f.userExtractor(msg)
-	sid, data, err := f.storage.Load(user.Identifier())
-	if err != nil {
+	user := f.userExtractor(u.msg)
+	sid, err := f.process(u, user)
+	if err == nil {
+		f.manager.Commit(u)
+		f.answer(u, nil)
 		return
 	}
+	var conflict *ConflictError
+	if errors.As(err, &conflict) {
+		// state was saved by another writer, process this message again with
+		// reloaded state, backing off so replicas do not keep conflicting
+		u.conflicts++
+		var d time.Duration
+		if f.backoff != nil {
+			d = f.backoff(u.conflicts)
+		}
+		f.manager.Postpone(u, d)
+		return nil
+	}
 
-	currentNode, ok := f.states[sid]
-	if !ok {
-		return fmt.Errorf("Cannot load state[%s] of user#%s", sid, user.Identifier())
+	u.attempts++
+	if f.retry == nil {
+		return
 	}
-	cur := currentNode.state.clone(user)
-	cur.SetData(data)
+	if f.retry(u.attempts, err) {
+		var d time.Duration
+		if f.backoff != nil {
+			d = f.backoff(u.attempts)
+		}
+		f.manager.Postpone(u, d)
+		return nil
+	}
+
+	// retries exhausted, drop the message
+	f.manager.Commit(u)
+	f.answer(u, err)
+	if f.deadLetter == nil {
+		return
+	}
+	f.deadLetter.DeadLetter(u.msg, user, sid, err)
+	return nil
+}
+
+// answer calls CallbackAnswerer if u is a callback query.
+func (f *fsm) answer(u *update, err error) {
+	if u.query != nil && f.answerer != nil {
+		f.answerer(u.query, err, f.api)
+	}
+}
 
+// process processes u through middlewares. Panics are converted to *PanicError.
+// sid is state of user before processing, empty if not loaded.
+func (f *fsm) process(u *update, user *telegram.Victim) (sid string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{r, debug.Stack()}
+		}
+	}()
+
+	var cur State
+	if sid, cur, err = f.load(u, user); err != nil {
+		return
+	}
+
+	h := f.handler(u)
+	for i := len(f.middlewares) - 1; i >= 0; i-- {
+		h = f.middlewares[i](h)
+	}
+	_, err = h(u.export(), cur, f.api)
+	return
+}
+
+// handler creates the innermost Handler, which tests transitors, transits and
+// saves according to u.
+func (f *fsm) handler(u *update) Handler {
 	doNext := func(cur State, msg *telegram.Message) (next State, err error) {
-		nextSID, err := cur.test(msg)
+		nextSID, err := f.test(u, cur)
 		if err != nil {
 			return
 		}
@@ -204,56 +601,241 @@ func (f *fsm) work() (err error) {
 		return f.transit(msg, cur, nextSID)
 	}
 
-	next, err := doNext(cur, msg)
-	if err != nil {
-		return
-	}
+	return func(upd Update, cur State, api telegram.API) (next State, err error) {
+		msg := upd.Message
+		if u.timer != nil && (f.timers.current(cur.User().Identifier()) != u.timer || cur.ID() != u.timer.From) {
+			// timer has been replaced or cancelled
+			return cur, nil
+		}
+		if ok, err := f.claim(u); !ok || err != nil {
+			return cur, err
+		}
 
-	for next.re() {
-		if next, err = doNext(next, msg); err != nil {
+		if u.timer != nil {
+			next, err = f.transit(msg, cur, u.timer.To)
+		} else {
+			next, err = doNext(cur, msg)
+		}
+		if err == ErrNoMatch && u.optional() {
+			// unmatched callback query (most likely a button of outdated message) or edited message
+			return cur, nil
+		}
+		if err != nil {
 			return
 		}
+
+		for next.re() {
+			if next, err = doNext(next, msg); err != nil {
+				return
+			}
+		}
+		return
+	}
+}
+
+// load loads state of user, ready to process u.
+func (f *fsm) load(u *update, user *telegram.Victim) (sid string, cur State, err error) {
+	sid, data, err := f.storage.Load(user.Identifier())
+	if err != nil {
+		return
 	}
 
-	f.manager.Commit(msg)
+	currentNode, ok := f.states[sid]
+	if !ok {
+		return sid, nil, fmt.Errorf("Cannot load state[%s] of user#%s", sid, user.Identifier())
+	}
+	cur = currentNode.state.clone(user)
+	data, history, calls := record(data)
+	cur.SetData(data)
+	if f.historyDepth > 0 {
+		cur.setHistory(history)
+	}
+	if len(f.flows) > 0 {
+		cur.setCalls(calls)
+	}
+	cur.setCallbackQuery(u.query)
+	if u.query == nil {
+		// text of callback query message is written by bot, not a command
+		f.parseCommand(cur, u.msg)
+	}
 	return
 }
 
 func (f *fsm) transit(msg *telegram.Message, current State, id string) (next State, err error) {
 	user := current.User()
+	if id, err = f.resolve(current, id); err != nil {
+		return
+	}
 	currentNode, ok := f.states[current.ID()]
 	if !ok {
-		return next, fmt.Errorf("Cannot load state[%s] of user#%d", current.ID(), user.Identifier())
+		return next, fmt.Errorf("Cannot load state[%s] of user#%s", current.ID(), user.Identifier())
 	}
 
 	nextNode, ok := f.states[id]
 	if !ok {
-		return next, fmt.Errorf("Cannot load next state[%s] of user#%d", id, user.Identifier())
+		return next, fmt.Errorf("Cannot load next state[%s] of user#%s", id, user.Identifier())
 	}
-	next = nextNode.state.clone(user)
 
 	if currentNode.leave != nil {
 		if err = currentNode.leave(msg, current, f.api); err != nil {
-			return
+			return f.recover(msg, current, current, err, nil)
+		}
+	}
+	for _, group := range f.leaving(current.ID(), id) {
+		if group.leave == nil {
+			continue
+		}
+		if err = group.leave(msg, current, f.api); err != nil {
+			return f.recover(msg, current, current, err, nil)
 		}
 	}
 
-	next.SetData(current.Data())
+	return f.enter(msg, current, nextNode, nil)
+}
 
+// enter enters the state of nextNode from current, and saves it. r is not nil
+// when entering an error state.
+func (f *fsm) enter(msg *telegram.Message, current State, nextNode internalStateData, r *recovery) (next State, err error) {
+	user := current.User()
+	next = nextNode.state.clone(user)
+	next.setCallbackQuery(current.CallbackQuery())
+	next.setCaptures(current.Captures())
+	next.setCommand(current.parsed(msg))
+	next.SetData(current.Data())
+	next.setHistory(f.nextHistory(current, next.ID()))
+	calls, result := f.nextCalls(current, next.ID())
+	next.setCalls(calls)
+	next.setResult(result)
+
+	for _, group := range f.entering(current.ID(), next.ID()) {
+		if group.enter == nil {
+			continue
+		}
+		if err = group.enter(msg, next, f.api); err != nil {
+			return f.recover(msg, current, next, err, r)
+		}
+	}
 	if nextNode.enter != nil {
 		if err = nextNode.enter(msg, next, f.api); err != nil {
-			return
+			return f.recover(msg, current, next, err, r)
 		}
 	}
 
-	err = f.storage.Save(user.Identifier(), next.ID(), next.Data())
-	if next.next() != nil {
-		next, err = f.transit(msg, next, *next.next())
+	return f.save(msg, next)
+}
+
+// save saves st, then transits further if enter action of st calls Transit, or
+// schedules its timer. History and calls are saved with state data in a Record.
+func (f *fsm) save(msg *telegram.Message, st State) (State, error) {
+	data := unrecord(st.Data(), st.History(), st.Calls())
+	if err := f.storage.Save(st.User().Identifier(), st.ID(), data); err != nil {
+		return nil, err
+	}
+	if st.next() != nil {
+		return f.transit(msg, st, *st.next())
 	}
+	f.schedule(st)
+	return st, nil
+}
+
+// recovery tracks error states entered to recover from a failed transition, so
+// error states failing to each other do not loop forever.
+type recovery struct {
+	origin  State    // state before the transition
+	err     error    // the first error
+	visited []string // failed states
+}
 
-	if next.re() {
+// recover handles err returned by action of failed state, which is current or next
+// state of the transition, according to error handler of failed state.
+func (f *fsm) recover(msg *telegram.Message, current, failed State, err error, r *recovery) (State, error) {
+	if r == nil {
+		r = &recovery{origin: current, err: err}
+	}
+	h, errorState := failed.errorHandler()
+	if h == nil && errorState == "" {
+		return nil, err
+	}
+	if h != nil {
+		if err = h(msg, failed, err, f.api); err != nil {
+			return nil, err
+		}
+	}
 
+	if errorState == "" || errorState == failed.ID() {
+		// stay in the state before transition, with data modified by error handler
+		stay := f.states[r.origin.ID()].state.clone(r.origin.User())
+		stay.SetData(failed.Data())
+		stay.setHistory(r.origin.History())
+		stay.setCalls(r.origin.Calls())
+		return f.save(msg, stay)
 	}
 
-	return
+	r.visited = append(r.visited, failed.ID())
+	for _, id := range r.visited {
+		if id == errorState {
+			// error states fail to each other
+			return nil, r.err
+		}
+	}
+	errorNode, ok := f.states[errorState]
+	if !ok {
+		return nil, fmt.Errorf("Cannot load error state[%s] of state[%s]", errorState, failed.ID())
+	}
+	return f.enter(msg, failed, errorNode, r)
+}
+
+// claim claims timer of timeout update from durable TimerStore. It returns
+// false if it is claimed by another FSM sharing the store.
+func (f *fsm) claim(u *update) (bool, error) {
+	ts, durable := unwrap(f.storage).(TimerStore)
+	if u.timer == nil || u.claimed || !durable {
+		return true, nil
+	}
+	ok, err := ts.ClaimTimer(f.userExtractor(u.msg).Identifier(), *u.timer)
+	u.claimed = ok
+	return ok, err
+}
+
+// schedule sets or cancels timer of the user according to state st.
+//
+// State has been saved, so failing to persist the timer does not fail the
+// message. It is logged, and the timer still works until restart.
+func (f *fsm) schedule(st State) {
+	uid := st.User().Identifier()
+	ts, durable := unwrap(f.storage).(TimerStore)
+	d := st.delay()
+	if d == nil {
+		if f.timers.cancel(uid) && durable {
+			if err := ts.DeleteTimer(uid); err != nil {
+				log.Printf("botgoram: cannot delete timer of user#%s: %s", uid, err)
+			}
+		}
+		return
+	}
+
+	t := &Timer{st.User(), st.ID(), d.id, time.Now().Add(d.duration)}
+	f.timers.set(uid, t)
+	if durable {
+		if err := ts.SaveTimer(uid, *t); err != nil {
+			log.Printf("botgoram: cannot save timer of user#%s: %s", uid, err)
+		}
+	}
+}
+
+// loadTimers restores persisted timers.
+func (f *fsm) loadTimers() error {
+	ts, ok := unwrap(f.storage).(TimerStore)
+	if !ok {
+		return nil
+	}
+	timers, err := ts.LoadTimers()
+	if err != nil {
+		return err
+	}
+	for i := range timers {
+		t := &timers[i]
+		f.timers.set(f.userExtractor(timeoutUpdate(t).msg).Identifier(), t)
+	}
+	return nil
 }
@@ -0,0 +1,415 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Patrolavia/telegram"
+)
+
+func TestStopDrainsQueue(t *testing.T) {
+	u1 := makeTestUser("user1")
+	ch := make(chan *telegram.Message)
+	store := MemoryStore(func(uid string) interface{} { return 0 })
+	f := NewBySender(nil, store, 1, ch)
+
+	f.AddState("counted", func(msg *telegram.Message, current State, api telegram.API) error {
+		current.SetData(current.Data().(int) + 1)
+		current.Transit(InitialState)
+		return nil
+	}, nil)
+	init, _ := f.State(InitialState)
+	init.RegisterFallback(func(msg *telegram.Message, state State) (string, error) {
+		return "counted", nil
+	})
+
+	result := make(chan error)
+	go func() { result <- f.Start(0) }()
+
+	for i := 0; i < 3; i++ {
+		ch <- &telegram.Message{ID: int64(i), Text: "test", From: u1, Chat: u1}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := f.Stop(ctx); err != nil {
+		t.Fatalf("Unexpected error when stopping fsm: %s", err)
+	}
+	if err := <-result; err != nil {
+		t.Errorf("Start should return nil after Stop, got %s", err)
+	}
+
+	sid, data, _ := store.Load(u1.Identifier())
+	if sid != InitialState || data.(int) != 3 {
+		t.Errorf("Expected all messages processed before stop, got state[%s] with data %v", sid, data)
+	}
+}
+
+func TestStopAfterWorkerError(t *testing.T) {
+	for _, size := range []int{1, 2} {
+		u1 := makeTestUser("user1")
+		ch := make(chan *telegram.Message)
+		f := NewBySender(nil, MemoryStore(func(uid string) interface{} { return nil }), size, ch)
+		broken := errors.New("broken")
+		f.AddState("next", func(msg *telegram.Message, current State, api telegram.API) error {
+			return broken
+		}, nil)
+		init, _ := f.State(InitialState)
+		init.RegisterFallback(func(msg *telegram.Message, state State) (string, error) {
+			return "next", nil
+		})
+
+		result := make(chan error)
+		go func() { result <- f.Start(0) }()
+		ch <- &telegram.Message{ID: 1, Text: "test", From: u1, Chat: u1}
+		if err := <-result; !errors.Is(err, broken) {
+			t.Fatalf("Expected Start returns error of worker with %d workers, got %v", size, err)
+		}
+
+		// the failed message stays in queue, but no worker is left to process it
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		if err := f.Stop(ctx); err != nil {
+			t.Errorf("Expected Stop returns without waiting failed message with %d workers, got %s", size, err)
+		}
+		cancel()
+	}
+}
+
+func TestStopDefaultFetcher(t *testing.T) {
+	f := NewBySender(nil, MemoryStore(nil), 1, nil).(*fsm)
+	go f.Start(0)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := f.Stop(ctx); err != nil {
+		t.Fatalf("Unexpected error when stopping fsm: %s", err)
+	}
+	if _, ok := <-f.fetcher.Message; ok {
+		t.Errorf("Expected fetcher stopped after Stop")
+	}
+}
+
+func TestCallbackQuery(t *testing.T) {
+	u1 := makeTestUser("user1")
+	ch := make(chan *telegram.Message)
+	queries := make(chan *telegram.CallbackQuery)
+	store := MemoryStore(func(uid string) interface{} { return "" })
+	f := NewBySender(nil, store, 1, ch)
+	f.CallbackQueries(queries)
+	var answered []string
+	f.AnswerCallbacks(func(q *telegram.CallbackQuery, err error, api telegram.API) {
+		answered = append(answered, q.ID)
+	})
+
+	f.AddState("pressed", func(msg *telegram.Message, current State, api telegram.API) error {
+		if current.Command() != "" {
+			return fmt.Errorf("Message of callback query parsed as command %s", current.Command())
+		}
+		current.SetData(current.CallbackQuery().Data + " by " + msg.From.FirstName)
+		return nil
+	}, nil)
+	init, _ := f.State(InitialState)
+	init.RegisterCallback("btn:", func(msg *telegram.Message, state State) (string, error) {
+		return "pressed", nil
+	})
+
+	go f.Start(0)
+	// unmatched callback query should be ignored
+	queries <- &telegram.CallbackQuery{ID: "1", From: u1, Data: "outdated"}
+	queries <- &telegram.CallbackQuery{ID: "2", From: u1, Data: "btn:ok", Message: &telegram.Message{ID: 1, Chat: u1, Text: "/menu"}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := f.Stop(ctx); err != nil {
+		t.Fatalf("Unexpected error when stopping fsm: %s", err)
+	}
+
+	if sid, data, _ := store.Load(u1.Identifier()); sid != "pressed" || data != "btn:ok by user1" {
+		t.Errorf("Expected button pressed, got state[%s] with data %v", sid, data)
+	}
+	if len(answered) != 2 || answered[0] != "1" || answered[1] != "2" {
+		t.Errorf("Expected both queries answered, got %v", answered)
+	}
+}
+
+func TestEditedMessage(t *testing.T) {
+	u1 := makeTestUser("user1")
+	ch := make(chan *telegram.Message)
+	edited := make(chan *telegram.Message)
+	store := MemoryStore(func(uid string) interface{} { return "" })
+	f := NewBySender(nil, store, 1, ch)
+	f.EditedMessages(edited)
+
+	f.AddState("answered", func(msg *telegram.Message, current State, api telegram.API) error {
+		current.SetData(msg.Text)
+		return nil
+	}, nil)
+	init, _ := f.State(InitialState)
+	init.RegisterFallback(func(msg *telegram.Message, state State) (string, error) {
+		return "answered", nil
+	})
+	answered, _ := f.State("answered")
+	answered.RegisterEdited(func(msg *telegram.Message, state State) (string, error) {
+		return "answered", nil
+	})
+
+	go f.Start(0)
+	// no edited transitor in initial state, ignored
+	edited <- &telegram.Message{ID: 1, Text: "ignored", From: u1, Chat: u1}
+	ch <- &telegram.Message{ID: 1, Text: "answer", From: u1, Chat: u1}
+	edited <- &telegram.Message{ID: 1, Text: "corrected", From: u1, Chat: u1}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := f.Stop(ctx); err != nil {
+		t.Fatalf("Unexpected error when stopping fsm: %s", err)
+	}
+
+	if sid, data, _ := store.Load(u1.Identifier()); sid != "answered" || data != "corrected" {
+		t.Errorf("Expected answer corrected, got state[%s] with data %v", sid, data)
+	}
+}
+
+func TestErrorState(t *testing.T) {
+	u1 := makeTestUser("user1")
+	ch := make(chan *telegram.Message)
+	store := MemoryStore(func(uid string) interface{} { return "" })
+	f := NewBySender(nil, store, 1, ch)
+	failure := errors.New("failed")
+	fail := func(msg *telegram.Message, current State, api telegram.API) error {
+		return failure
+	}
+
+	// enter action fails, go to error state
+	st, _ := f.AddState("enter", fail, nil)
+	st.OnError(func(msg *telegram.Message, current State, err error, api telegram.API) error {
+		current.SetData(err.Error())
+		return nil
+	}, "sorry")
+	f.AddState("sorry", nil, nil)
+	// leave action fails, stay without error state
+	st, _ = f.AddState("leave", nil, fail)
+	st.OnError(func(msg *telegram.Message, current State, err error, api telegram.API) error {
+		return nil
+	}, "")
+
+	init, _ := f.State(InitialState)
+	init.RegisterFallback(func(msg *telegram.Message, state State) (string, error) {
+		return msg.Text, nil
+	})
+	sorry, _ := f.State("sorry")
+	sorry.RegisterFallback(func(msg *telegram.Message, state State) (string, error) {
+		return msg.Text, nil
+	})
+	leave, _ := f.State("leave")
+	leave.RegisterFallback(func(msg *telegram.Message, state State) (string, error) {
+		return msg.Text, nil
+	})
+
+	go f.Start(0)
+	ch <- &telegram.Message{ID: 1, Text: "enter", From: u1, Chat: u1}
+	ch <- &telegram.Message{ID: 2, Text: "leave", From: u1, Chat: u1}
+	ch <- &telegram.Message{ID: 3, Text: "sorry", From: u1, Chat: u1}
+	stopFSM(t, f)
+
+	if sid, data, _ := store.Load(u1.Identifier()); sid != "leave" || data != "failed" {
+		t.Errorf("Expected user stays in state[leave] with data from error handler, got state[%s] with data %v", sid, data)
+	}
+}
+
+func TestErrorStay(t *testing.T) {
+	u1 := makeTestUser("user1")
+	ch := make(chan *telegram.Message)
+	store := MemoryStore(func(uid string) interface{} { return "" })
+	f := NewBySender(nil, store, 1, ch)
+	st, _ := f.AddState("broken", func(msg *telegram.Message, current State, api telegram.API) error {
+		return errors.New("failed")
+	}, nil)
+	st.OnError(func(msg *telegram.Message, current State, err error, api telegram.API) error {
+		current.SetData("fixed")
+		return nil
+	}, "")
+	init, _ := f.State(InitialState)
+	init.RegisterFallback(func(msg *telegram.Message, state State) (string, error) {
+		return "broken", nil
+	})
+
+	go f.Start(0)
+	ch <- &telegram.Message{ID: 1, Text: "test", From: u1, Chat: u1}
+	stopFSM(t, f)
+
+	if sid, data, _ := store.Load(u1.Identifier()); sid != InitialState || data != "fixed" {
+		t.Errorf("Expected user stays in initial state with data from error handler, got state[%s] with data %v", sid, data)
+	}
+}
+
+func TestErrorStateLoop(t *testing.T) {
+	u1 := makeTestUser("user1")
+	ch := make(chan *telegram.Message)
+	f := NewBySender(nil, MemoryStore(func(uid string) interface{} { return nil }), 1, ch)
+	failure := errors.New("first")
+	a, _ := f.AddState("a", func(msg *telegram.Message, current State, api telegram.API) error {
+		return failure
+	}, nil)
+	a.OnError(nil, "b")
+	b, _ := f.AddState("b", func(msg *telegram.Message, current State, api telegram.API) error {
+		return errors.New("second")
+	}, nil)
+	b.OnError(nil, "a")
+	init, _ := f.State(InitialState)
+	init.RegisterFallback(func(msg *telegram.Message, state State) (string, error) {
+		return "a", nil
+	})
+
+	result := make(chan error)
+	go func() { result <- f.Start(0) }()
+	ch <- &telegram.Message{ID: 1, Text: "test", From: u1, Chat: u1}
+	if err := <-result; err != failure {
+		t.Errorf("Expected original error from error states failing to each other, got %v", err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	u1 := makeTestUser("user1")
+	banned := makeTestUser("banned")
+	ch := make(chan *telegram.Message)
+	store := MemoryStore(func(uid string) interface{} { return "" })
+	f := NewBySender(nil, store, 1, ch)
+	f.AddState("next", nil, nil)
+	init, _ := f.State(InitialState)
+	init.RegisterFallback(func(msg *telegram.Message, state State) (string, error) {
+		return "next", nil
+	})
+
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(u Update, current State, api telegram.API) (State, error) {
+				order = append(order, fmt.Sprintf("%s:%s[%s]", name, current.User().FirstName, current.ID()))
+				st, err := next(u, current, api)
+				if st != nil {
+					order = append(order, name+"->"+st.ID())
+				}
+				return st, err
+			}
+		}
+	}
+	block := func(next Handler) Handler {
+		return func(u Update, current State, api telegram.API) (State, error) {
+			if current.User().FirstName == "banned" {
+				return current, nil
+			}
+			return next(u, current, api)
+		}
+	}
+	f.Use(trace("outer"), block, trace("inner"))
+
+	go f.Start(0)
+	ch <- &telegram.Message{ID: 1, Text: "test", From: banned, Chat: banned}
+	ch <- &telegram.Message{ID: 2, Text: "test", From: u1, Chat: u1}
+	stopFSM(t, f)
+
+	if sid, _, _ := store.Load(banned.Identifier()); sid != InitialState {
+		t.Errorf("Banned user should not transit, got state[%s]", sid)
+	}
+	if sid, _, _ := store.Load(u1.Identifier()); sid != "next" {
+		t.Errorf("Expected user transits to next, got state[%s]", sid)
+	}
+	expect := "[outer:banned[] outer-> outer:user1[] inner:user1[] inner->next outer->next]"
+	if fmt.Sprint(order) != expect {
+		t.Errorf("Unexpected middleware calls: %v", order)
+	}
+}
+
+func TestMiddlewareUpdate(t *testing.T) {
+	u1 := makeTestUser("user1")
+	ch := make(chan *telegram.Message)
+	edited := make(chan *telegram.Message)
+	queries := make(chan *telegram.CallbackQuery)
+	f := NewBySender(nil, MemoryStore(func(uid string) interface{} { return "" }), 1, ch)
+	f.EditedMessages(edited)
+	f.CallbackQueries(queries)
+	f.AddState("next", nil, nil)
+	init, _ := f.State(InitialState)
+	init.RegisterFallback(func(msg *telegram.Message, state State) (string, error) {
+		return "next", nil
+	})
+
+	var seen []string
+	f.Use(func(next Handler) Handler {
+		return func(u Update, current State, api telegram.API) (State, error) {
+			seen = append(seen, fmt.Sprintf("%d:%s[%s]", u.Kind, u.Message.Text, current.ID()))
+			if (u.Kind == UpdateCallback) != (u.Query != nil) {
+				t.Errorf("Expected callback query only in UpdateCallback, got %#v", u)
+			}
+			return next(u, current, api)
+		}
+	})
+
+	go f.Start(0)
+	ch <- &telegram.Message{ID: 1, Text: "hi", From: u1, Chat: u1}
+	edited <- &telegram.Message{ID: 1, Text: "hello", From: u1, Chat: u1}
+	queries <- &telegram.CallbackQuery{ID: "1", From: u1, Data: "btn", Message: &telegram.Message{ID: 2, Chat: u1, Text: "menu"}}
+	stopFSM(t, f)
+
+	expect := fmt.Sprint([]string{
+		fmt.Sprintf("%d:hi[]", UpdateMessage),
+		fmt.Sprintf("%d:hello[next]", UpdateEdited),
+		fmt.Sprintf("%d:menu[next]", UpdateCallback),
+	})
+	if fmt.Sprint(seen) != expect {
+		t.Errorf("Expected middleware sees %v, got %v", expect, seen)
+	}
+}
+
+// conflictStore conflicts on first n saves.
+type conflictStore struct {
+	SaveLoader
+	n int
+}
+
+func (s *conflictStore) Save(uid string, sid string, data interface{}) error {
+	if s.n > 0 {
+		s.n--
+		return &ConflictError{uid}
+	}
+	return s.SaveLoader.Save(uid, sid, data)
+}
+
+func TestConflictBacksOff(t *testing.T) {
+	u1 := makeTestUser("user1")
+	ch := make(chan *telegram.Message)
+	store := &conflictStore{MemoryStore(func(uid string) interface{} { return nil }), 2}
+	f := NewBySender(nil, store, 1, ch)
+	f.AddState("next", nil, nil)
+	init, _ := f.State(InitialState)
+	init.RegisterFallback(func(msg *telegram.Message, state State) (string, error) {
+		return "next", nil
+	})
+	f.Use(func(next Handler) Handler {
+		return func(u Update, current State, api telegram.API) (State, error) {
+			st, err := next(u, current, api)
+			if err != nil {
+				err = fmt.Errorf("observed: %w", err)
+			}
+			return st, err
+		}
+	})
+	f.SetBackoff(ExponentialBackoff(50*time.Millisecond, time.Second))
+
+	begin := time.Now()
+	go f.Start(0)
+	defer stopFSM(t, f)
+	ch <- &telegram.Message{ID: 1, Text: "hi", From: u1, Chat: u1}
+	if sid := waitState(store, u1.Identifier(), "next", 2*time.Second); sid != "next" {
+		t.Fatalf("Expected message retried after conflicts, got state[%s]", sid)
+	}
+	if elapsed := time.Since(begin); elapsed < 150*time.Millisecond {
+		t.Errorf("Expected conflicts to back off 50ms and 100ms, got %s", elapsed)
+	}
+}
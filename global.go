@@ -0,0 +1,68 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+// GlobalPrecedence defines the order of matching global transitors and transitors
+// of current state.
+type GlobalPrecedence int
+
+// valid precedences
+const (
+	// Global commands are matched first, other global transitors are matched
+	// after state transitors, including fallback ones. This is the default.
+	GlobalCommandFirst GlobalPrecedence = iota
+	// Global transitors are matched before state transitors.
+	GlobalFirst
+	// Global transitors are matched after state transitors.
+	GlobalLast
+)
+
+// global transitors are shared among all states, and apply to messages only.
+// Callback queries, edited messages and timeouts do not go through them.
+
+func (f *fsm) RegisterGlobal(mt string, t Transitor) {
+	f.global.Register(mt, t)
+}
+
+func (f *fsm) RegisterGlobalCommand(cmd string, t Transitor) {
+	f.global.RegisterCommand(cmd, t)
+}
+
+func (f *fsm) RegisterGlobalFallback(t Transitor) {
+	f.global.RegisterFallback(t)
+}
+
+func (f *fsm) SetGlobalPrecedence(p GlobalPrecedence) {
+	f.precedence = p
+}
+
+// test finds next state of cur according to u, with global transitors.
+func (f *fsm) test(u *update, cur State) (next string, err error) {
+	if u.query != nil || u.edited {
+		return f.testGroup(u, cur)
+	}
+
+	msg := u.msg
+	tests := []func() (string, error){
+		func() (string, error) { return f.testGroup(u, cur) },
+		func() (string, error) { return f.global.match(msg, cur) },
+	}
+	switch f.precedence {
+	case GlobalFirst:
+		tests[0], tests[1] = tests[1], tests[0]
+	case GlobalCommandFirst:
+		// global commands have been tested, skip them in later pass
+		tests[1] = func() (string, error) { return f.global.matchSkipping(msg, cur, true) }
+		tests = append([]func() (string, error){
+			func() (string, error) { return f.global.matchCommand(msg, cur) },
+		}, tests...)
+	}
+
+	for _, test := range tests {
+		if next, err = test(); err == nil {
+			return
+		}
+	}
+	return
+}
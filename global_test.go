@@ -0,0 +1,86 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"testing"
+
+	"github.com/Patrolavia/telegram"
+)
+
+func TestGlobalTransitors(t *testing.T) {
+	cases := []struct {
+		precedence GlobalPrecedence
+		text       string
+		expect     string
+	}{
+		{GlobalCommandFirst, "/cancel", "cancelled"},
+		{GlobalCommandFirst, "text", "local"},
+		{GlobalLast, "/cancel", "local"},
+		{GlobalFirst, "text", "global"},
+	}
+
+	for _, c := range cases {
+		u := makeTestUser("user1")
+		ch := make(chan *telegram.Message)
+		store := MemoryStore(func(uid string) interface{} { return "" })
+		f := NewBySender(nil, store, 1, ch)
+		f.AddState("ask", nil, nil)
+		f.AddState("cancelled", nil, nil)
+		f.AddState("local", nil, nil)
+		f.AddState("global", nil, nil)
+		init, _ := f.State(InitialState)
+		init.RegisterFallback(func(msg *telegram.Message, state State) (string, error) {
+			return "ask", nil
+		})
+		ask, _ := f.State("ask")
+		ask.RegisterFallback(func(msg *telegram.Message, state State) (string, error) {
+			return "local", nil
+		})
+		f.RegisterGlobalCommand("/cancel", func(msg *telegram.Message, state State) (string, error) {
+			if state.ID() != "ask" {
+				t.Errorf("Global transitor should receive current state, got state[%s]", state.ID())
+			}
+			return "cancelled", nil
+		})
+		f.RegisterGlobal(TextMsg, func(msg *telegram.Message, state State) (string, error) {
+			return "global", nil
+		})
+		f.SetGlobalPrecedence(c.precedence)
+
+		go f.Start(0)
+		ch <- &telegram.Message{ID: 1, Text: "/start", From: u, Chat: u}
+		ch <- &telegram.Message{ID: 2, Text: c.text, From: u, Chat: u}
+		stopFSM(t, f)
+
+		if sid, _, _ := store.Load(u.Identifier()); sid != c.expect {
+			t.Errorf("Expected %q with precedence %d transits to %s, got state[%s]", c.text, c.precedence, c.expect, sid)
+		}
+	}
+}
+
+// a global command not matching falls through without being tested again
+func TestGlobalCommandOnce(t *testing.T) {
+	u := makeTestUser("user1")
+	ch := make(chan *telegram.Message)
+	store := MemoryStore(func(uid string) interface{} { return "" })
+	f := NewBySender(nil, store, 1, ch)
+	f.AddState("help", nil, nil)
+	calls := 0
+	f.RegisterGlobalCommand("/help", func(msg *telegram.Message, state State) (string, error) {
+		calls++
+		return "", ErrNoMatch
+	})
+	f.RegisterGlobalFallback(func(msg *telegram.Message, state State) (string, error) {
+		return "help", nil
+	})
+
+	go f.Start(0)
+	ch <- &telegram.Message{ID: 1, Text: "/help", From: u, Chat: u}
+	stopFSM(t, f)
+
+	if sid, _, _ := store.Load(u.Identifier()); sid != "help" || calls != 1 {
+		t.Errorf("Expected global command tested once and fallback to help, got %d calls and state[%s]", calls, sid)
+	}
+}
@@ -0,0 +1,241 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"sort"
+	"time"
+)
+
+// AnyState is the source of global transitors in Graph.
+const AnyState = "*"
+
+// EdgeKind classifies edges of Graph.
+type EdgeKind string
+
+// valid edge kinds
+const (
+	TypeEdge     EdgeKind = "type"
+	CommandEdge  EdgeKind = "command"
+	FallbackEdge EdgeKind = "fallback"
+	CallbackEdge EdgeKind = "callback"
+	EditedEdge   EdgeKind = "edited"
+	ForwardEdge  EdgeKind = "forward"
+	ReplyEdge    EdgeKind = "reply"
+	TimeoutEdge  EdgeKind = "timeout"
+	HiddenEdge   EdgeKind = "hidden" // a call to Transit(id)
+	CallEdge     EdgeKind = "call"   // calling a subflow
+	ReturnEdge   EdgeKind = "return" // returning from a subflow
+	ErrorEdge    EdgeKind = "error"  // transiting to error state
+)
+
+// Graph is the state map declared by StateMakers, rendered by Renderer.
+// States and edges are sorted, so the JSON form is stable across runs.
+type Graph struct {
+	Initial string       `json:"initial"` // name of InitialState in diagram
+	States  []GraphState `json:"states"`
+	Edges   []GraphEdge  `json:"edges"`
+}
+
+// GraphState is a state in Graph.
+type GraphState struct {
+	ID           string `json:"id"`
+	Enter        bool   `json:"enter,omitempty"`        // has enter action
+	Leave        bool   `json:"leave,omitempty"`        // has leave action
+	Parent       string `json:"parent,omitempty"`       // see State.SetParent
+	Flow         string `json:"flow,omitempty"`         // name of subflow it belongs to
+	Undocumented bool   `json:"undocumented,omitempty"` // referred but not declared by StateMaker
+}
+
+// GraphEdge is a transitor in Graph.
+type GraphEdge struct {
+	From     string        `json:"from"`
+	To       string        `json:"to"`
+	Kind     EdgeKind      `json:"kind"`
+	Type     string        `json:"type,omitempty"`
+	Command  string        `json:"command,omitempty"`
+	Callback string        `json:"callback,omitempty"`
+	Timeout  time.Duration `json:"timeout,omitempty"` // nanoseconds in JSON
+	Flow     string        `json:"flow,omitempty"`    // subflow called or returned from
+	Match    string        `json:"match,omitempty"`   // description of Matcher
+	Desc     string        `json:"desc,omitempty"`
+	Hidden   bool          `json:"hidden,omitempty"`
+	Fallback bool          `json:"fallback,omitempty"`
+}
+
+// less orders edges by every field, so sorting does not depend on registering order.
+func (e GraphEdge) less(o GraphEdge) bool {
+	switch {
+	case e.From != o.From:
+		return e.From < o.From
+	case e.To != o.To:
+		return e.To < o.To
+	case e.Kind != o.Kind:
+		return e.Kind < o.Kind
+	case e.Type != o.Type:
+		return e.Type < o.Type
+	case e.Command != o.Command:
+		return e.Command < o.Command
+	case e.Callback != o.Callback:
+		return e.Callback < o.Callback
+	case e.Timeout != o.Timeout:
+		return e.Timeout < o.Timeout
+	case e.Flow != o.Flow:
+		return e.Flow < o.Flow
+	case e.Match != o.Match:
+		return e.Match < o.Match
+	case e.Desc != o.Desc:
+		return e.Desc < o.Desc
+	case e.Hidden != o.Hidden:
+		return !e.Hidden
+	}
+	return !e.Fallback && o.Fallback
+}
+
+// Lines describes the edge, one line per item.
+func (e GraphEdge) Lines() (ret []string) {
+	if e.Desc != "" {
+		ret = append(ret, e.Desc)
+	}
+	switch e.Kind {
+	case TypeEdge:
+		if e.Type != "" {
+			ret = append(ret, e.Type)
+		}
+	case CommandEdge:
+		ret = append(ret, "Command: "+e.Command)
+	case CallbackEdge:
+		ret = append(ret, "Callback: "+e.Callback)
+	case TimeoutEdge:
+		ret = append(ret, "timeout: "+e.Timeout.String())
+	case CallEdge, ReturnEdge:
+		ret = append(ret, string(e.Kind)+": "+e.Flow)
+	case ErrorEdge:
+		ret = append(ret, "on error")
+	case FallbackEdge, EditedEdge, ForwardEdge, ReplyEdge:
+		ret = append(ret, string(e.Kind))
+	}
+	if e.Match != "" {
+		ret = append(ret, e.Match)
+	}
+	return
+}
+
+// Display returns id used in diagram, which is Initial for InitialState.
+func (g *Graph) Display(id string) string {
+	if id == InitialState {
+		return g.Initial
+	}
+	return id
+}
+
+func edgeKind(t TransitorMap) EdgeKind {
+	switch {
+	case t.IsHidden:
+		return HiddenEdge
+	case t.Timeout > 0:
+		return TimeoutEdge
+	case t.IsFallback:
+		return FallbackEdge
+	case t.IsCallback:
+		return CallbackEdge
+	case t.IsEdited:
+		return EditedEdge
+	case t.IsForward:
+		return ForwardEdge
+	case t.IsReply:
+		return ReplyEdge
+	case t.Command != "" && t.Type == TextMsg:
+		return CommandEdge
+	}
+	return TypeEdge
+}
+
+func (f *fsm) Graph(name string) *Graph {
+	g := &Graph{Initial: name}
+	states := map[string]*GraphState{InitialState: {ID: InitialState}}
+	flows := make(map[string]string)
+	for fn, flow := range f.flows {
+		for _, sm := range flow.States {
+			flows[sm.Name()] = fn
+		}
+	}
+	for _, s := range f.sm {
+		enter, leave := s.Actions()
+		states[s.Name()] = &GraphState{ID: s.Name(), Enter: enter != nil, Leave: leave != nil}
+	}
+	addEdge := func(e GraphEdge) {
+		for _, id := range []string{e.From, e.To} {
+			if _, ok := states[id]; !ok && id != AnyState {
+				states[id] = &GraphState{ID: id, Undocumented: true}
+			}
+		}
+		g.Edges = append(g.Edges, e)
+	}
+
+	for _, s := range f.sm {
+		n := s.Name()
+		for _, t := range s.Transitors() {
+			e := GraphEdge{
+				From:     t.State,
+				To:       n,
+				Kind:     edgeKind(t),
+				Type:     t.Type,
+				Command:  t.Command,
+				Callback: t.Callback,
+				Timeout:  t.Timeout,
+				Desc:     t.Desc,
+				Hidden:   t.IsHidden,
+				Fallback: t.IsFallback,
+			}
+			if t.Match != nil {
+				e.Match = t.Match.String()
+			}
+			switch {
+			case t.IsHidden:
+				e.From, e.To = n, t.State
+			case t.Call != "":
+				entry := t.Call
+				if flow, ok := f.flows[t.Call]; ok {
+					entry = flow.Entry
+				}
+				e.To, e.Kind, e.Flow = entry, CallEdge, t.Call
+				addEdge(GraphEdge{From: entry, To: n, Kind: ReturnEdge, Flow: t.Call})
+			case t.IsGlobal:
+				e.From = AnyState
+			}
+			addEdge(e)
+		}
+
+		if r, ok := unwrap(s).(ErrorRecoverer); ok {
+			if _, es := r.ErrorRecovery(); es != "" {
+				addEdge(GraphEdge{From: n, To: es, Kind: ErrorEdge})
+			}
+		}
+	}
+
+	// parent states are always in graph, even if no transitor refers to them
+	queue := make([]string, 0, len(states))
+	for id := range states {
+		queue = append(queue, id)
+	}
+	for len(queue) > 0 {
+		st := states[queue[0]]
+		queue = queue[1:]
+		if node, ok := f.states[st.ID]; ok {
+			st.Parent = node.state.Parent()
+		}
+		st.Flow = flows[st.ID]
+		if _, ok := states[st.Parent]; st.Parent != "" && !ok {
+			states[st.Parent] = &GraphState{ID: st.Parent, Undocumented: true}
+			queue = append(queue, st.Parent)
+		}
+	}
+	for _, st := range states {
+		g.States = append(g.States, *st)
+	}
+	sort.Slice(g.States, func(i, j int) bool { return g.States[i].ID < g.States[j].ID })
+	sort.Slice(g.Edges, func(i, j int) bool { return g.Edges[i].less(g.Edges[j]) })
+	return g
+}
@@ -0,0 +1,115 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// JSON exports g as indented JSON. Since states and edges are sorted, same state
+// map always exports to same bytes, which is suitable for diffing across releases.
+func (g *Graph) JSON() ([]byte, error) {
+	return json.MarshalIndent(g, "", "\t")
+}
+
+// ReadGraph reads Graph exported by Graph.JSON, sorting states and edges again in
+// case it was edited by hand.
+func ReadGraph(r io.Reader) (*Graph, error) {
+	g := &Graph{}
+	if err := json.NewDecoder(r).Decode(g); err != nil {
+		return nil, fmt.Errorf("Cannot read graph: %w", err)
+	}
+	sort.Slice(g.States, func(i, j int) bool { return g.States[i].ID < g.States[j].ID })
+	sort.Slice(g.Edges, func(i, j int) bool { return g.Edges[i].less(g.Edges[j]) })
+	return g, nil
+}
+
+// GraphDiff is the difference between two Graphs. States are compared by ID, edges
+// by all fields.
+type GraphDiff struct {
+	AddedStates   []GraphState `json:"added_states,omitempty"`
+	RemovedStates []GraphState `json:"removed_states,omitempty"`
+	AddedEdges    []GraphEdge  `json:"added_edges,omitempty"`
+	RemovedEdges  []GraphEdge  `json:"removed_edges,omitempty"`
+}
+
+// Empty reports whether two graphs have same states and edges.
+func (d GraphDiff) Empty() bool {
+	return len(d.AddedStates)+len(d.RemovedStates)+len(d.AddedEdges)+len(d.RemovedEdges) == 0
+}
+
+// String lists differences one per line, prefixed by "+" or "-".
+func (d GraphDiff) String() string {
+	var buf strings.Builder
+	for _, s := range d.RemovedStates {
+		fmt.Fprintf(&buf, "- state %q\n", s.ID)
+	}
+	for _, s := range d.AddedStates {
+		fmt.Fprintf(&buf, "+ state %q\n", s.ID)
+	}
+	edge := func(sign string, e GraphEdge) {
+		fmt.Fprintf(&buf, "%s edge %q -> %q (%s)", sign, e.From, e.To, e.Kind)
+		if l := e.Lines(); len(l) > 0 {
+			buf.WriteString(": " + strings.Join(l, ", "))
+		}
+		buf.WriteString("\n")
+	}
+	for _, e := range d.RemovedEdges {
+		edge("-", e)
+	}
+	for _, e := range d.AddedEdges {
+		edge("+", e)
+	}
+	return buf.String()
+}
+
+// DiffGraph reports states and edges added to or removed from old in cur.
+// Duplicated edges are counted, so removing one of two identical transitors is
+// reported.
+func DiffGraph(old, cur *Graph) (d GraphDiff) {
+	oldStates := make(map[string]bool)
+	for _, s := range old.States {
+		oldStates[s.ID] = true
+	}
+	newStates := make(map[string]bool)
+	for _, s := range cur.States {
+		newStates[s.ID] = true
+		if !oldStates[s.ID] {
+			d.AddedStates = append(d.AddedStates, s)
+		}
+	}
+	for _, s := range old.States {
+		if !newStates[s.ID] {
+			d.RemovedStates = append(d.RemovedStates, s)
+		}
+	}
+
+	edges := make(map[GraphEdge]int)
+	for _, e := range old.Edges {
+		edges[e]++
+	}
+	for _, e := range cur.Edges {
+		if edges[e] > 0 {
+			edges[e]--
+			continue
+		}
+		d.AddedEdges = append(d.AddedEdges, e)
+	}
+	for _, e := range old.Edges {
+		if edges[e] > 0 {
+			edges[e]--
+			d.RemovedEdges = append(d.RemovedEdges, e)
+		}
+	}
+
+	sort.Slice(d.AddedStates, func(i, j int) bool { return d.AddedStates[i].ID < d.AddedStates[j].ID })
+	sort.Slice(d.RemovedStates, func(i, j int) bool { return d.RemovedStates[i].ID < d.RemovedStates[j].ID })
+	sort.Slice(d.AddedEdges, func(i, j int) bool { return d.AddedEdges[i].less(d.AddedEdges[j]) })
+	sort.Slice(d.RemovedEdges, func(i, j int) bool { return d.RemovedEdges[i].less(d.RemovedEdges[j]) })
+	return
+}
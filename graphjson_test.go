@@ -0,0 +1,67 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestGraphJSON(t *testing.T) {
+	data, err := makeDiagramFSM().Graph("start").JSON()
+	if err != nil {
+		t.Fatalf("Cannot export graph: %s", err)
+	}
+	for i := 0; i < 5; i++ {
+		again, _ := makeDiagramFSM().Graph("start").JSON()
+		if !bytes.Equal(data, again) {
+			t.Fatalf("Expected stable export, got\n%s\nand\n%s", data, again)
+		}
+	}
+	for _, expect := range []string{
+		`"initial": "start"`,
+		`"id": "ghost",` + "\n\t\t\t\"undocumented\": true",
+		`"kind": "timeout",` + "\n\t\t\t\"timeout\": 60000000000",
+	} {
+		if !strings.Contains(string(data), expect) {
+			t.Errorf("Expected %s in export, got\n%s", expect, data)
+		}
+	}
+
+	g, err := ReadGraph(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Cannot read exported graph: %s", err)
+	}
+	if d := DiffGraph(makeDiagramFSM().Graph("start"), g); !d.Empty() {
+		t.Errorf("Expected no difference after round trip, got\n%s", d)
+	}
+}
+
+func TestDiffGraph(t *testing.T) {
+	old := makeDiagramFSM().Graph("start")
+	cur := makeDiagramFSM()
+	cur.MakeState(nestedState{"help", "", nil, nil, []TransitorMap{
+		{State: "menu", Type: TextMsg, Command: "/help"},
+	}})
+	d := DiffGraph(old, cur.Graph("start"))
+	if len(d.AddedStates) != 1 || d.AddedStates[0].ID != "help" || len(d.RemovedStates) != 0 {
+		t.Errorf("Expected state help added, got %+v", d)
+	}
+	if len(d.AddedEdges) != 1 || d.AddedEdges[0].Command != "/help" || len(d.RemovedEdges) != 0 {
+		t.Errorf("Expected edge to help added, got %+v", d)
+	}
+
+	d = DiffGraph(cur.Graph("start"), old)
+	expect := "- state \"help\"\n- edge \"menu\" -> \"help\" (command): Command: /help\n"
+	if actual := d.String(); actual != expect {
+		t.Errorf("Expected diff %q, got %q", expect, actual)
+	}
+
+	dup := *old
+	dup.Edges = append(append([]GraphEdge{}, old.Edges...), old.Edges[0])
+	if d = DiffGraph(&dup, old); len(d.RemovedEdges) != 1 || d.RemovedEdges[0] != old.Edges[0] {
+		t.Errorf("Expected duplicated edge removed, got %+v", d)
+	}
+}
@@ -0,0 +1,85 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import "fmt"
+
+// ancestors returns parent states of state id, from the nearest one.
+// Groups must be checked by checkGroups first.
+func (f *fsm) ancestors(id string) (ret []internalStateData) {
+	for {
+		node, ok := f.states[id]
+		if !ok || node.state.Parent() == "" {
+			return
+		}
+		id = node.state.Parent()
+		ret = append(ret, f.states[id])
+	}
+}
+
+// checkGroups ensures every parent state exists and no state is an ancestor of itself.
+func (f *fsm) checkGroups() error {
+	for id, node := range f.states {
+		seen := map[string]bool{id: true}
+		for p := node.state.Parent(); p != ""; {
+			parent, ok := f.states[p]
+			if !ok {
+				return fmt.Errorf("Cannot find parent state[%s] of state[%s]", p, id)
+			}
+			if seen[p] {
+				return fmt.Errorf("State[%s] is an ancestor of itself", p)
+			}
+			seen[p] = true
+			p = parent.state.Parent()
+		}
+	}
+	return nil
+}
+
+// inGroup reports whether state id is group itself or any of its descendants.
+func (f *fsm) inGroup(id, group string) bool {
+	if id == group {
+		return true
+	}
+	for _, p := range f.ancestors(id) {
+		if p.state.ID() == group {
+			return true
+		}
+	}
+	return false
+}
+
+// leaving returns groups left when transiting from state "from" to "to", from the innermost one.
+func (f *fsm) leaving(from, to string) (ret []internalStateData) {
+	for _, p := range f.ancestors(from) {
+		if !f.inGroup(to, p.state.ID()) {
+			ret = append(ret, p)
+		}
+	}
+	return
+}
+
+// entering returns groups entered when transiting from state "from" to "to", from the outermost one.
+func (f *fsm) entering(from, to string) (ret []internalStateData) {
+	groups := f.ancestors(to)
+	for i := len(groups) - 1; i >= 0; i-- {
+		if !f.inGroup(from, groups[i].state.ID()) {
+			ret = append(ret, groups[i])
+		}
+	}
+	return
+}
+
+// testGroup tests transitors of cur, then transitors of its ancestors.
+func (f *fsm) testGroup(u *update, cur State) (next string, err error) {
+	if next, err = u.test(cur); err == nil {
+		return
+	}
+	for _, p := range f.ancestors(cur.ID()) {
+		if next, err = u.match(p.state.(*state), cur); err == nil {
+			return
+		}
+	}
+	return
+}
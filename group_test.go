@@ -0,0 +1,88 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Patrolavia/telegram"
+)
+
+type nestedState struct {
+	name, parent string
+	enter, leave Action
+	trans        []TransitorMap
+}
+
+func (s nestedState) Name() string                   { return s.name }
+func (s nestedState) Actions() (enter, leave Action) { return s.enter, s.leave }
+func (s nestedState) Transitors() []TransitorMap     { return s.trans }
+func (s nestedState) Parent() string                 { return s.parent }
+
+func TestNestedStates(t *testing.T) {
+	u := makeTestUser("user1")
+	ch := make(chan *telegram.Message)
+	store := MemoryStore(func(uid string) interface{} { return "" })
+	f := NewBySender(nil, store, 1, ch)
+
+	var actions []string
+	trace := func(prefix string) Action {
+		return func(msg *telegram.Message, current State, api telegram.API) error {
+			actions = append(actions, prefix+current.ID())
+			return nil
+		}
+	}
+	to := func(next string) Transitor {
+		return func(msg *telegram.Message, state State) (string, error) {
+			if next == "cancelled" && state.ID() != "checkout.pay" {
+				t.Errorf("Inherited transitor should receive current state, got state[%s]", state.ID())
+			}
+			return next, nil
+		}
+	}
+
+	f.MakeState(nestedState{"checkout", "", trace("enter group: "), trace("leave group: "), nil})
+	f.MakeState(nestedState{"checkout.address", "checkout", trace(""), nil, []TransitorMap{
+		{Transitor: to("checkout.address"), State: InitialState, Type: TextMsg},
+	}})
+	f.MakeState(nestedState{"checkout.pay", "checkout", trace(""), nil, []TransitorMap{
+		{Transitor: to("checkout.pay"), State: "checkout.address", Type: TextMsg},
+	}})
+	f.MakeState(nestedState{"cancelled", "", trace(""), nil, []TransitorMap{
+		{Transitor: to("cancelled"), State: "checkout", Type: TextMsg, Command: "/cancel"},
+	}})
+	if dot := f.StateMap("start"); !strings.Contains(dot, `subgraph "cluster_checkout"`) {
+		t.Errorf("Expected checkout group drawn as cluster, got %s", dot)
+	}
+
+	go f.Start(0)
+	for i, text := range []string{"address", "card", "/cancel"} {
+		ch <- &telegram.Message{ID: int64(i), Text: text, From: u, Chat: u}
+	}
+	stopFSM(t, f)
+
+	if sid, _, _ := store.Load(u.Identifier()); sid != "cancelled" {
+		t.Errorf("Expected user cancelled by transitor of parent state, got state[%s]", sid)
+	}
+	expect := []string{
+		"enter group: checkout.address", "checkout.address",
+		"checkout.pay",
+		"leave group: checkout.pay", "cancelled",
+	}
+	if strings.Join(actions, ",") != strings.Join(expect, ",") {
+		t.Errorf("Unexpected actions: %v", actions)
+	}
+}
+
+func TestNestedStatesCycle(t *testing.T) {
+	f := NewBySender(nil, MemoryStore(func(uid string) interface{} { return "" }), 1, make(chan *telegram.Message))
+	a, _ := f.AddState("a", nil, nil)
+	b, _ := f.AddState("b", nil, nil)
+	a.SetParent("b")
+	b.SetParent("a")
+	if err := f.Start(0); err == nil {
+		t.Errorf("Expected error starting FSM with cyclic groups")
+	}
+}
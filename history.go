@@ -0,0 +1,41 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import "github.com/Patrolavia/telegram"
+
+// Back returns a transitor going back n steps in history. It does not match if
+// there are less than n states in history. See State.Back.
+func Back(n int) Transitor {
+	return func(msg *telegram.Message, state State) (string, error) {
+		if !state.Back(n) {
+			return "", ErrNoMatch
+		}
+		return state.History()[n-1], nil
+	}
+}
+
+func (f *fsm) SetHistoryDepth(n int) {
+	f.historyDepth = n
+}
+
+// nextHistory computes history after transiting from current to state id.
+func (f *fsm) nextHistory(current State, id string) []string {
+	if f.historyDepth <= 0 {
+		return nil
+	}
+	h := current.History()
+	if n := current.backSteps(); n > 0 && n <= len(h) && h[n-1] == id {
+		return h[n:]
+	}
+	if !current.recorded() || current.ID() == id {
+		return h
+	}
+
+	h = append([]string{current.ID()}, h...)
+	if len(h) > f.historyDepth {
+		h = h[:f.historyDepth]
+	}
+	return h
+}
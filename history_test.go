@@ -0,0 +1,61 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Patrolavia/telegram"
+)
+
+func TestHistory(t *testing.T) {
+	u := makeTestUser("user1")
+	ch := make(chan *telegram.Message)
+	store := MemoryStore(func(uid string) interface{} { return "" })
+	f := NewBySender(nil, store, 1, ch)
+	f.SetHistoryDepth(2)
+
+	steps := map[string]string{InitialState: "name", "name": "confirm", "confirm": "phone", "phone": "address"}
+	for from, to := range steps {
+		if from != InitialState {
+			f.AddState(from, nil, nil)
+		}
+		to := to
+		st, _ := f.State(from)
+		st.Register(TextMsg, func(msg *telegram.Message, state State) (string, error) {
+			return to, nil
+		})
+	}
+	f.AddState("address", nil, nil)
+	confirm, _ := f.State("confirm")
+	confirm.DisableHistory()
+	f.RegisterGlobalCommand("/back", Back(1))
+
+	var history [][]string
+	f.Use(func(next Handler) Handler {
+		return func(u Update, current State, api telegram.API) (State, error) {
+			st, err := next(u, current, api)
+			if st != nil {
+				history = append(history, st.History())
+			}
+			return st, err
+		}
+	})
+
+	go f.Start(0)
+	for i, text := range []string{"a", "b", "c", "d", "/back", "/back"} {
+		ch <- &telegram.Message{ID: int64(i), Text: text, From: u, Chat: u}
+	}
+	stopFSM(t, f)
+
+	// confirm is not recorded, and history is limited to 2 steps
+	expect := fmt.Sprintf("%q", [][]string{{""}, {"name", ""}, {"name", ""}, {"phone", "name"}, {"name"}, {}})
+	if fmt.Sprintf("%q", history) != expect {
+		t.Errorf("Unexpected history: %q", history)
+	}
+	if sid, _, _ := store.Load(u.Identifier()); sid != "name" {
+		t.Errorf("Expected user goes back to name, got state[%s]", sid)
+	}
+}
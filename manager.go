@@ -4,39 +4,152 @@
 package botgoram
 
 import (
+	"container/list"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/Patrolavia/telegram"
 )
 
-type msgq struct {
-	msg  *telegram.Message
-	next *msgq
+// update is what we queue in manager: a message, an edited message, a callback query
+// or a timeout.
+type update struct {
+	// For callback queries, msg is a copy of the message the query originated
+	// from, with sender replaced by who pressed the button.
+	// For timeouts, msg is an empty message from the user.
+	msg       *telegram.Message
+	query     *telegram.CallbackQuery
+	edited    bool
+	timer     *Timer
+	claimed   bool // timer has been claimed from TimerStore
+	attempts  int  // failed times
+	conflicts int  // times saving conflicted with another writer, not counted in attempts
 }
 
+func messageUpdate(msg *telegram.Message) *update {
+	return &update{msg: msg}
+}
+
+func editedUpdate(msg *telegram.Message) *update {
+	return &update{msg: msg, edited: true}
+}
+
+func callbackUpdate(q *telegram.CallbackQuery) *update {
+	msg := &telegram.Message{Chat: q.From}
+	if q.Message != nil {
+		m := *q.Message
+		msg = &m
+	}
+	msg.From = q.From
+	return &update{msg: msg, query: q}
+}
+
+func timeoutUpdate(t *Timer) *update {
+	return &update{
+		msg: &telegram.Message{
+			From: t.User,
+			Chat: t.User,
+			Date: t.Deadline.Unix(),
+		},
+		timer: t,
+	}
+}
+
+// export describes u for Handlers.
+func (u *update) export() Update {
+	ret := Update{UpdateMessage, u.msg, u.query, u.timer}
+	switch {
+	case u.query != nil:
+		ret.Kind = UpdateCallback
+	case u.edited:
+		ret.Kind = UpdateEdited
+	case u.timer != nil:
+		ret.Kind = UpdateTimeout
+	}
+	return ret
+}
+
+// test matches state transitors according to update type.
+func (u *update) test(s State) (next string, err error) {
+	switch {
+	case u.query != nil:
+		return s.testCallback(u.msg)
+	case u.edited:
+		return s.testEdited(u.msg)
+	}
+	return s.test(u.msg)
+}
+
+// match is like test, but tests transitors of s and passes cur to them.
+func (u *update) match(s *state, cur State) (next string, err error) {
+	switch {
+	case u.query != nil:
+		return s.matchCallback(u.msg, cur)
+	case u.edited:
+		return s.edited.test(u.msg, cur)
+	}
+	return s.match(u.msg, cur)
+}
+
+// optional reports whether the update can be ignored when no transitor matches.
+func (u *update) optional() bool {
+	return u.query != nil || u.edited
+}
+
+// userq is message queue of a user.
+type userq struct {
+	uid     string
+	msgs    []*update
+	running bool          // first message is being processed
+	held    bool          // first message is postponed, see Postpone
+	ready   *list.Element // position in ready queue, nil if not in it
+}
+
+// manager dispatches queued messages to workers. Messages of one user are
+// processed in order, never concurrently.
+//
+// Each user has its own queue. A user waiting to be processed is put in ready
+// queue, so all operations are O(1).
 type manager struct {
-	size         int
-	runningUsers map[string]bool
-	root         *msgq
-	qsize        int
-	lock         sync.Locker
-	cond         *sync.Cond
-	getUID       func(*telegram.Message) *telegram.Victim
-	msgs         chan *telegram.Message
+	size      int
+	users     map[string]*userq
+	ready     *list.List // of *userq
+	running   int        // number of users being processed
+	qsize     int
+	lock      sync.Locker
+	cond      *sync.Cond
+	getUID    func(*telegram.Message) *telegram.Victim
+	msgs      chan *telegram.Message
+	queries   chan *telegram.CallbackQuery
+	edited    chan *telegram.Message
+	closed    bool
+	receiving bool // Run is receiving messages
+	quit      chan struct{}
+	// msgs is closed by its writer after Close, Run keeps receiving until then
+	drain   bool
+	workers int // number of workers not stopped by error
 }
 
 func newManager(f func(*telegram.Message) *telegram.Victim, size int, msgs chan *telegram.Message) *manager {
 	l := new(sync.Mutex)
 	return &manager{
 		size,
-		make(map[string]bool),
-		nil,
+		make(map[string]*userq),
+		list.New(),
+		0,
 		0,
 		l,
 		sync.NewCond(l),
 		f,
 		msgs,
+		nil,
+		nil,
+		false,
+		false,
+		make(chan struct{}),
+		false,
+		size,
 	}
 }
 
@@ -44,104 +157,242 @@ func (m *manager) GetUID(msg *telegram.Message) *telegram.Victim {
 	return m.getUID(msg)
 }
 
-func (m *manager) Commit(msg *telegram.Message) {
+// release marks q not running, put it back to ready queue if there are still messages.
+func (m *manager) release(q *userq, front bool) {
+	q.running = false
+	m.running--
+	switch {
+	case len(q.msgs) == 0:
+		delete(m.users, q.uid)
+	case front:
+		q.ready = m.ready.PushFront(q)
+	default:
+		q.ready = m.ready.PushBack(q)
+	}
+}
+
+func (m *manager) Commit(msg *update) {
 	m.lock.Lock()
-	defer m.cond.Signal()
+	defer m.cond.Broadcast()
 	defer m.lock.Unlock()
 
-	delete(m.runningUsers, m.getUID(msg).Identifier())
-	// delete msg from Q
-	if m.root == nil {
+	q, ok := m.users[m.getUID(msg.msg).Identifier()]
+	if !ok || len(q.msgs) == 0 {
 		log.Fatal("botgoram: There is no queued message to be deleted! There must be something wrong in botgoram.")
 	}
-
-	if m.root.msg == msg {
-		m.root = m.root.next
-		m.qsize--
-		return
+	if !q.running || q.msgs[0] != msg {
+		log.Fatal("botgoram: I can't find matched message to delete from queue. There must be something wrong in botgoram.")
 	}
 
-	prev := m.root
-	cur := m.root.next
-	for cur != nil {
-		if cur.msg != msg {
-			prev = cur
-			cur = cur.next
-			continue
-		}
+	q.msgs[0] = nil
+	q.msgs = q.msgs[1:]
+	m.qsize--
+	m.release(q, false)
+}
 
-		prev.next = cur.next
-		m.qsize--
+// Rollback leaves msg in queue, so it will be processed again, before other users.
+func (m *manager) Rollback(msg *update) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	q, ok := m.users[m.getUID(msg.msg).Identifier()]
+	if !ok || !q.running || q.msgs[0] != msg { // committed
 		return
 	}
-
-	log.Fatal("botgoram: I can't find matched message to delete from queue. There must be something wrong in botgoram.")
+	m.release(q, true)
+	m.cond.Broadcast()
 }
 
-func (m *manager) Rollback(msg *telegram.Message) {
-	if ok := m.runningUsers[m.getUID(msg).Identifier()]; !ok {
+// Postpone leaves msg in queue like Rollback, but the user is held for d before
+// msg is processed again. Later messages of the user wait too.
+func (m *manager) Postpone(msg *update, d time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	q, ok := m.users[m.getUID(msg.msg).Identifier()]
+	if !ok || !q.running || q.msgs[0] != msg { // committed
 		return
 	}
-	m.lock.Lock()
-	delete(m.runningUsers, m.getUID(msg).Identifier())
-	m.lock.Unlock()
-	m.cond.Signal()
+	q.running = false
+	q.held = true
+	m.running--
+	m.cond.Broadcast()
+	time.AfterFunc(d, func() {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		q.held = false
+		q.ready = m.ready.PushFront(q)
+		m.cond.Broadcast()
+	})
 }
 
-func (m *manager) getFirstNew() (ret *telegram.Message) {
-	cur := m.root
-
-	for cur != nil {
-		if !m.runningUsers[m.getUID(cur.msg).Identifier()] {
-			m.runningUsers[m.getUID(cur.msg).Identifier()] = true
-			return cur.msg
-		}
-		cur = cur.next
+func (m *manager) getFirstNew() (ret *update) {
+	front := m.ready.Front()
+	if front == nil {
+		return
 	}
 
-	return
+	q := m.ready.Remove(front).(*userq)
+	q.ready = nil
+	q.running = true
+	m.running++
+	return q.msgs[0]
 }
 
-func (m *manager) Begin() *telegram.Message {
+// Begin blocks until there is a message ready to be processed.
+// It returns nil once the manager is closed and every queued message is done.
+func (m *manager) Begin() *update {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
 	msg := m.getFirstNew()
 	for ; msg == nil; msg = m.getFirstNew() {
+		if m.closed && !m.receiving && m.qsize == 0 {
+			return nil
+		}
 		m.cond.Wait()
 	}
 	return msg
 }
 
+func (m *manager) setReceiving(r bool) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		r = false
+	}
+	m.receiving = r
+	m.cond.Broadcast()
+	return r
+}
+
+// setSources sets channels of callback queries and edited messages, nil ones
+// are left unchanged.
+func (m *manager) setSources(queries chan *telegram.CallbackQuery, edited chan *telegram.Message) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if queries != nil {
+		m.queries = queries
+	}
+	if edited != nil {
+		m.edited = edited
+	}
+}
+
 func (m *manager) Run() {
-	for msg := range m.msgs {
-		m.feed(msg)
+	if !m.setReceiving(true) {
+		return
+	}
+	defer m.setReceiving(false)
+	quit := m.quit
+	if m.drain {
+		quit = nil
+	}
+	m.lock.Lock()
+	queries, edited := m.queries, m.edited
+	m.lock.Unlock()
+	for {
+		select {
+		case <-quit:
+			return
+		case msg, ok := <-m.msgs:
+			if !ok {
+				return
+			}
+			m.feed(messageUpdate(msg))
+		case q := <-queries:
+			m.feed(callbackUpdate(q))
+		case msg := <-edited:
+			m.feed(editedUpdate(msg))
+		}
 	}
 }
 
-func (m *manager) add(msg *telegram.Message) {
-	if m.root == nil {
-		m.root = &msgq{msg, nil}
+// Close stops accepting new messages. Queued messages are still handed out by Begin.
+func (m *manager) Close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
 		return
 	}
+	m.closed = true
+	close(m.quit)
+	m.cond.Broadcast()
+}
+
+// isClosed reports whether Close has been called.
+func (m *manager) isClosed() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.closed
+}
+
+// retire records a worker stopped by error. Messages left in queue are not
+// waited by Wait once all workers have stopped.
+func (m *manager) retire() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.workers--
+	m.cond.Broadcast()
+}
+
+// Wait blocks until message queue is drained and no message is being processed.
+// It should be called after Close.
+func (m *manager) Wait() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for m.receiving || m.running > 0 || (m.qsize > 0 && m.workers > 0) {
+		m.cond.Wait()
+	}
+}
 
-	cur := m.root
-	for cur.next != nil {
-		cur = cur.next
+func (m *manager) add(msg *update) {
+	uid := m.getUID(msg.msg).Identifier()
+	q, ok := m.users[uid]
+	if !ok {
+		q = &userq{uid: uid}
+		m.users[uid] = q
+	}
+	q.msgs = append(q.msgs, msg)
+	if !q.running && !q.held && q.ready == nil {
+		q.ready = m.ready.PushBack(q)
 	}
-	cur.next = &msgq{msg, nil}
 }
 
-func (m *manager) feed(msg *telegram.Message) {
+func (m *manager) feed(msg *update) {
 	m.lock.Lock()
 	m.add(msg)
 	m.qsize++
 	m.lock.Unlock()
-	m.cond.Signal()
+	m.cond.Broadcast()
 
 	m.lock.Lock()
 	defer m.lock.Unlock()
-	for m.qsize >= m.size || len(m.runningUsers) >= m.size {
+	for !m.closed && (m.qsize >= m.size || m.running >= m.size) {
 		m.cond.Wait()
 	}
 }
+
+// inject queues an update generated by botgoram. It returns false if manager is closed.
+func (m *manager) inject(msg *update) bool {
+	m.lock.Lock()
+	closed := m.closed
+	m.lock.Unlock()
+	if closed {
+		return false
+	}
+	m.feed(msg)
+	return true
+}
+
+// tryFeed queues msg without blocking. It returns false if manager is closed,
+// or feed would block.
+func (m *manager) tryFeed(msg *update) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed || m.qsize >= m.size || m.running >= m.size {
+		return false
+	}
+	m.add(msg)
+	m.qsize++
+	m.cond.Broadcast()
+	return true
+}
@@ -24,18 +24,18 @@ func TestManagerWithTwoUser(t *testing.T) {
 	ch := make(chan *telegram.Message)
 
 	m := newManager(bySender, 2, ch)
-	m1 := &telegram.Message{
+	m1 := messageUpdate(&telegram.Message{
 		ID:   1,
 		Text: "test",
 		From: u1,
 		Chat: u1,
-	}
-	m2 := &telegram.Message{
+	})
+	m2 := messageUpdate(&telegram.Message{
 		ID:   2,
 		Text: "test",
 		From: u2,
 		Chat: u2,
-	}
+	})
 	go func() {
 		m.feed(m1)
 		m.feed(m2)
@@ -56,18 +56,18 @@ func TestManagerWithOneUser(t *testing.T) {
 	ch := make(chan *telegram.Message)
 
 	m := newManager(bySender, 2, ch)
-	m1 := &telegram.Message{
+	m1 := messageUpdate(&telegram.Message{
 		ID:   1,
 		Text: "test",
 		From: u1,
 		Chat: u1,
-	}
-	m2 := &telegram.Message{
+	})
+	m2 := messageUpdate(&telegram.Message{
 		ID:   2,
 		Text: "test",
 		From: u1,
 		Chat: u1,
-	}
+	})
 	go func() {
 		m.feed(m1)
 		m.feed(m2)
@@ -83,3 +83,100 @@ func TestManagerWithOneUser(t *testing.T) {
 		t.Errorf("Got different message in test 2 msg#2.")
 	}
 }
+
+func TestManagerClose(t *testing.T) {
+	u1 := makeTestUser("user1")
+	ch := make(chan *telegram.Message)
+
+	m := newManager(bySender, 2, ch)
+	m1 := messageUpdate(&telegram.Message{
+		ID:   1,
+		Text: "test",
+		From: u1,
+		Chat: u1,
+	})
+	m.feed(m1)
+	m.Close()
+
+	actual := m.Begin()
+	if actual != m1 {
+		t.Fatalf("Queued message should still be processed after closing manager.")
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		m.Wait()
+		close(drained)
+	}()
+	m.Commit(m1)
+	<-drained
+
+	if actual = m.Begin(); actual != nil {
+		t.Errorf("Expected nil message from drained manager, got msg#%d", actual.msg.ID)
+	}
+}
+
+// messages of one user are processed in order, and other users are not blocked by him
+func TestManagerOrder(t *testing.T) {
+	u1 := makeTestUser("user1")
+	u2 := makeTestUser("user2")
+	m := newManager(bySender, 10, make(chan *telegram.Message))
+	msgs := []*update{
+		messageUpdate(&telegram.Message{ID: 1, From: u1, Chat: u1}),
+		messageUpdate(&telegram.Message{ID: 2, From: u1, Chat: u1}),
+		messageUpdate(&telegram.Message{ID: 3, From: u2, Chat: u2}),
+	}
+	for _, msg := range msgs {
+		m.feed(msg)
+	}
+
+	if actual := m.Begin(); actual != msgs[0] {
+		t.Fatalf("Expected msg#1, got msg#%d", actual.msg.ID)
+	}
+	// user1 is busy, so we get user2's message
+	if actual := m.Begin(); actual != msgs[2] {
+		t.Fatalf("Expected msg#3, got msg#%d", actual.msg.ID)
+	}
+	m.Rollback(msgs[0])
+	if actual := m.Begin(); actual != msgs[0] {
+		t.Fatalf("Expected rolled back msg#1, got msg#%d", actual.msg.ID)
+	}
+	m.Commit(msgs[0])
+	m.Rollback(msgs[0]) // no-op after commit
+	if actual := m.Begin(); actual != msgs[1] {
+		t.Fatalf("Expected msg#2, got msg#%d", actual.msg.ID)
+	}
+	m.Rollback(msgs[0]) // must not release msg#2
+	m.Commit(msgs[1])
+	m.Commit(msgs[2])
+	if m.qsize != 0 || m.running != 0 || len(m.users) != 0 || m.ready.Len() != 0 {
+		t.Errorf("Manager is not empty after all messages committed.")
+	}
+}
+
+func benchmarkManager(b *testing.B, backlog int) {
+	users := make([]*telegram.Victim, 100)
+	for i := range users {
+		users[i] = makeTestUser("user")
+	}
+	msgs := make([]*update, backlog)
+	for i := range msgs {
+		msgs[i] = messageUpdate(&telegram.Message{ID: int64(i), From: users[i%len(users)], Chat: users[i%len(users)]})
+	}
+	m := newManager(bySender, backlog+1, make(chan *telegram.Message))
+	for _, msg := range msgs {
+		m.feed(msg)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// keep backlog messages in queue, process one and feed one
+		msg := m.Begin()
+		m.Commit(msg)
+		m.feed(msg)
+	}
+}
+
+func BenchmarkManagerBacklog100(b *testing.B)   { benchmarkManager(b, 100) }
+func BenchmarkManagerBacklog1000(b *testing.B)  { benchmarkManager(b, 1000) }
+func BenchmarkManagerBacklog10000(b *testing.B) { benchmarkManager(b, 10000) }
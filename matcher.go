@@ -0,0 +1,187 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Patrolavia/telegram"
+)
+
+// Matcher is a declarative condition of messages, which can be used in
+// TransitorMap instead of writing a Transitor. String() describes the condition
+// in state map.
+type Matcher interface {
+	Match(msg *telegram.Message, state State) bool
+	String() string
+}
+
+// matchers registering to specific message type, others are registered as fallback.
+type registerer interface {
+	register(st State, t Transitor)
+}
+
+type textMatcher string
+
+// Text matches text messages equal to text.
+func Text(text string) Matcher {
+	return textMatcher(text)
+}
+
+func (m textMatcher) Match(msg *telegram.Message, state State) bool {
+	return msg.Text == string(m)
+}
+
+func (m textMatcher) String() string {
+	return fmt.Sprintf("text == %q", string(m))
+}
+
+func (m textMatcher) register(st State, t Transitor) {
+	st.Register(TextMsg, t)
+}
+
+type regexpMatcher struct {
+	re *regexp.Regexp
+}
+
+// Regexp matches text messages against expr. Submatches are available by
+// State.Captures() in the next state. It panics if expr cannot compile.
+func Regexp(expr string) Matcher {
+	return regexpMatcher{regexp.MustCompile(expr)}
+}
+
+func (m regexpMatcher) Match(msg *telegram.Message, state State) bool {
+	matches := m.re.FindStringSubmatch(msg.Text)
+	if matches == nil {
+		return false
+	}
+	state.setCaptures(matches)
+	return true
+}
+
+func (m regexpMatcher) String() string {
+	return "text =~ /" + m.re.String() + "/"
+}
+
+func (m regexpMatcher) register(st State, t Transitor) {
+	st.Register(TextMsg, t)
+}
+
+type commandMatcher struct {
+	cmd  string
+	args []string
+}
+
+// Command matches command cmd with at least len(args) arguments. args are names
+// of arguments, only for state map generating. Arguments are available by
+// State.Captures() in the next state.
+func Command(cmd string, args ...string) Matcher {
+	return commandMatcher{cmd, args}
+}
+
+func (m commandMatcher) Match(msg *telegram.Message, state State) bool {
+	pc := state.parsed(msg)
+	if pc == nil || !pc.is(m.cmd) || len(pc.args) < len(m.args) {
+		return false
+	}
+	state.setCaptures(pc.args)
+	return true
+}
+
+func (m commandMatcher) String() string {
+	ret := m.cmd
+	for _, a := range m.args {
+		ret += " <" + a + ">"
+	}
+	return ret
+}
+
+func (m commandMatcher) register(st State, t Transitor) {
+	st.RegisterCommand(m.cmd, t)
+}
+
+type typeMatcher string
+
+// Type matches messages of type mt.
+func Type(mt string) Matcher {
+	return typeMatcher(mt)
+}
+
+func (m typeMatcher) Match(msg *telegram.Message, state State) bool {
+	return msgType(msg) == string(m)
+}
+
+func (m typeMatcher) String() string {
+	return "type: " + string(m)
+}
+
+func (m typeMatcher) register(st State, t Transitor) {
+	st.Register(string(m), t)
+}
+
+type guardMatcher struct {
+	desc string
+	f    func(msg *telegram.Message, state State) bool
+}
+
+// Guard matches messages which f returns true, desc describes it in state map.
+func Guard(desc string, f func(msg *telegram.Message, state State) bool) Matcher {
+	return guardMatcher{desc, f}
+}
+
+func (m guardMatcher) Match(msg *telegram.Message, state State) bool {
+	return m.f(msg, state)
+}
+
+func (m guardMatcher) String() string {
+	return "guard: " + m.desc
+}
+
+type andMatcher []Matcher
+
+// And matches messages matching all of ms, in order. It registers like the
+// first matcher.
+func And(ms ...Matcher) Matcher {
+	return andMatcher(ms)
+}
+
+func (m andMatcher) Match(msg *telegram.Message, state State) bool {
+	for _, x := range m {
+		if !x.Match(msg, state) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m andMatcher) String() string {
+	desc := make([]string, len(m))
+	for i, x := range m {
+		desc[i] = x.String()
+	}
+	return strings.Join(desc, " && ")
+}
+
+func (m andMatcher) register(st State, t Transitor) {
+	if len(m) > 0 {
+		if r, ok := m[0].(registerer); ok {
+			r.register(st, t)
+			return
+		}
+	}
+	st.RegisterFallback(t)
+}
+
+// matchTransitor transits to next if m matches.
+func matchTransitor(m Matcher, next string) Transitor {
+	return func(msg *telegram.Message, state State) (string, error) {
+		if !m.Match(msg, state) {
+			state.setCaptures(nil)
+			return "", ErrNoMatch
+		}
+		return next, nil
+	}
+}
@@ -0,0 +1,78 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Patrolavia/telegram"
+)
+
+func TestMatchers(t *testing.T) {
+	f := NewBySender(nil, MemoryStore(nil), 1, make(chan *telegram.Message)).(*fsm)
+	isAdmin := func(msg *telegram.Message, state State) bool { return msg.From.Username == "admin" }
+	makers := []flowState{
+		{"hello", nil, []TransitorMap{{State: InitialState, Match: Text("hi")}}},
+		{"order", nil, []TransitorMap{{State: InitialState, Match: Command("/order", "item", "qty")}}},
+		{"number", nil, []TransitorMap{{State: InitialState, Match: Regexp(`^(\d+)-(\d+)$`)}}},
+		{"photo", nil, []TransitorMap{{State: InitialState, Match: Type(PhotoMsg)}}},
+		{"admin", nil, []TransitorMap{{State: InitialState, Match: And(Text("sudo"), Guard("is admin", isAdmin))}}},
+		{"guarded", nil, []TransitorMap{{State: InitialState, Match: Guard("is admin", isAdmin)}}},
+	}
+	for _, m := range makers {
+		f.MakeState(m)
+	}
+	if err := f.registerStateMapTransitors(); err != nil {
+		t.Fatalf("Cannot register transitors: %s", err)
+	}
+
+	st, _ := f.State(InitialState)
+	user := &telegram.Victim{Username: "user"}
+	admin := &telegram.Victim{Username: "admin"}
+	cases := []struct {
+		msg      *telegram.Message
+		next     string
+		captures []string
+	}{
+		{&telegram.Message{Text: "hi", From: user}, "hello", nil},
+		{&telegram.Message{Text: "/order apple 3", From: user}, "order", []string{"apple", "3"}},
+		{&telegram.Message{Text: "12-34", From: user}, "number", []string{"12-34", "12", "34"}},
+		{&telegram.Message{Photo: []telegram.PhotoSize{}, From: user}, "photo", nil},
+		{&telegram.Message{Text: "sudo", From: admin}, "admin", nil},
+		{&telegram.Message{Text: "sudo", From: user}, "", nil},
+		{&telegram.Message{Text: "/order apple", From: user}, "", nil},
+		{&telegram.Message{Text: "anything", From: admin}, "guarded", nil},
+	}
+	for _, c := range cases {
+		cur := st.clone(c.msg.From)
+		next, err := cur.test(c.msg)
+		if c.next == "" {
+			if err == nil {
+				t.Errorf("Expected %q matches nothing, got state[%s]", c.msg.Text, next)
+			}
+			continue
+		}
+		if err != nil || next != c.next {
+			t.Errorf("Expected %q transits to %s, got state[%s], err %v", c.msg.Text, c.next, next, err)
+		}
+		if strings.Join(cur.Captures(), ",") != strings.Join(c.captures, ",") {
+			t.Errorf("Unexpected captures of %q: %q", c.msg.Text, cur.Captures())
+		}
+	}
+}
+
+func TestMatcherString(t *testing.T) {
+	cases := map[string]Matcher{
+		`text == "hi"`:                Text("hi"),
+		`/order <item> <qty>`:         Command("/order", "item", "qty"),
+		`text =~ /^\d+$/`:             Regexp(`^\d+$`),
+		`type: PHOTO && guard: small`: And(Type(PhotoMsg), Guard("small", nil)),
+	}
+	for expect, m := range cases {
+		if actual := m.String(); actual != expect {
+			t.Errorf("Expected matcher described as %s, got %s", expect, actual)
+		}
+	}
+}
@@ -3,6 +3,12 @@
 
 package botgoram
 
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
 // StateInitializer returns an initialized state data.
 type StateInitializer func(uid string) interface{}
 
@@ -14,32 +20,104 @@ type SaveLoader interface {
 	Load(uid string) (sid string, data interface{}, err error)
 }
 
+// Record is what FSM saves as state data when history or subflows are enabled,
+// so they are saved atomically with state, by one Save. Data is the state data.
+//
+// Codecs in this package encode Record natively, custom codecs have to handle it.
+// Loading data which is not a Record means empty history and no pending call.
+type Record struct {
+	Data    interface{}
+	History []string
+	Calls   []Frame
+}
+
+type memoryEntry struct {
+	uid    string
+	sid    string
+	data   interface{}
+	access time.Time
+}
+
 type memoryStore struct {
-	data  map[string]interface{}
-	state map[string]string
-	init  StateInitializer
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // most recently used first
+	init    StateInitializer
+	ttl     time.Duration
+	max     int
+	now     func() time.Time
 }
 
 // MemoryStore provides default, memory based SaveLoader implementation.
+// It is safe for concurrent use, and never evicts anything.
 func MemoryStore(init StateInitializer) SaveLoader {
+	return ExpiringMemoryStore(init, 0, 0)
+}
+
+// ExpiringMemoryStore is a MemoryStore which forgets idle users.
+//
+// A user not accessed (Save or Load) for ttl is evicted, and least recently used
+// users are evicted when there are more than max users. Evicted users come back to
+// InitialState with freshly initialized data. Zero ttl or max disables the limit.
+func ExpiringMemoryStore(init StateInitializer, ttl time.Duration, max int) SaveLoader {
 	return &memoryStore{
-		make(map[string]interface{}),
-		make(map[string]string),
-		init,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		init:    init,
+		ttl:     ttl,
+		max:     max,
+		now:     time.Now,
+	}
+}
+
+func (m *memoryStore) expired(e *memoryEntry, now time.Time) bool {
+	return m.ttl > 0 && now.Sub(e.access) >= m.ttl
+}
+
+func (m *memoryStore) remove(elem *list.Element) {
+	m.lru.Remove(elem)
+	delete(m.entries, elem.Value.(*memoryEntry).uid)
+}
+
+// evict removes expired entries and entries exceeding max size, from least recently used.
+func (m *memoryStore) evict(now time.Time) {
+	for elem := m.lru.Back(); elem != nil; elem = m.lru.Back() {
+		if !m.expired(elem.Value.(*memoryEntry), now) && (m.max <= 0 || m.lru.Len() <= m.max) {
+			return
+		}
+		m.remove(elem)
 	}
 }
 
 func (m *memoryStore) Save(uid string, sid string, data interface{}) error {
-	m.data[uid] = data
-	m.state[uid] = sid
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := m.now()
+	if elem, ok := m.entries[uid]; ok {
+		e := elem.Value.(*memoryEntry)
+		e.sid, e.data, e.access = sid, data, now
+		m.lru.MoveToFront(elem)
+	} else {
+		m.entries[uid] = m.lru.PushFront(&memoryEntry{uid, sid, data, now})
+	}
+	m.evict(now)
 	return nil
 }
 
 func (m *memoryStore) Load(uid string) (sid string, data interface{}, err error) {
-	data, ok := m.data[uid]
-	sid = m.state[uid]
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := m.now()
+	m.evict(now)
+	elem, ok := m.entries[uid]
 	if !ok {
-		data = m.init(uid)
+		return InitialState, m.init(uid), nil
 	}
-	return
+
+	e := elem.Value.(*memoryEntry)
+	e.access = now
+	m.lru.MoveToFront(elem)
+	return e.sid, e.data, nil
 }
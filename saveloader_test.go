@@ -0,0 +1,73 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreConcurrent(t *testing.T) {
+	store := MemoryStore(func(uid string) interface{} { return uid })
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(uid string) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				store.Save(uid, "state", j)
+				store.Load(uid)
+			}
+		}(fmt.Sprint(i))
+	}
+	wg.Wait()
+
+	if sid, data, _ := store.Load("3"); sid != "state" || data.(int) != 99 {
+		t.Errorf("Expected last saved data, got state[%s] with data %v", sid, data)
+	}
+}
+
+func TestMemoryStoreTTL(t *testing.T) {
+	now := time.Now()
+	store := ExpiringMemoryStore(func(uid string) interface{} { return "init" }, time.Minute, 0).(*memoryStore)
+	store.now = func() time.Time { return now }
+
+	store.Save("user", "state", "data")
+	now = now.Add(30 * time.Second)
+	if sid, data, _ := store.Load("user"); sid != "state" || data != "data" {
+		t.Errorf("User should not expire before ttl, got state[%s] with data %v", sid, data)
+	}
+
+	// Load refreshes access time
+	now = now.Add(59 * time.Second)
+	if sid, _, _ := store.Load("user"); sid != "state" {
+		t.Errorf("Access time should be refreshed by Load, got state[%s]", sid)
+	}
+
+	now = now.Add(time.Minute)
+	if sid, data, _ := store.Load("user"); sid != InitialState || data != "init" {
+		t.Errorf("Expired user should be reset to initial state, got state[%s] with data %v", sid, data)
+	}
+	if len(store.entries) != 0 {
+		t.Errorf("Expired user is not removed from memory.")
+	}
+}
+
+func TestMemoryStoreMaxEntries(t *testing.T) {
+	store := ExpiringMemoryStore(func(uid string) interface{} { return "init" }, 0, 2)
+
+	store.Save("user1", "state", 1)
+	store.Save("user2", "state", 2)
+	store.Load("user1") // user2 is least recently used now
+	store.Save("user3", "state", 3)
+
+	if sid, _, _ := store.Load("user2"); sid != InitialState {
+		t.Errorf("Least recently used user should be evicted, got state[%s]", sid)
+	}
+	if sid, _, _ := store.Load("user1"); sid != "state" {
+		t.Errorf("Recently used user should be kept, got state[%s]", sid)
+	}
+}
@@ -0,0 +1,286 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"bytes"
+	"container/list"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// max number of cached versions of SQLSaveLoader
+const sqlVersionCache = 10000
+
+// ConflictError denotes state of the user has been saved by another writer since
+// it was loaded. FSM retries the message with reloaded state when it gets one,
+// running actions again, so actions should be idempotent when using SaveLoaders
+// which return it.
+type ConflictError struct {
+	UID string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("State of user#%s has been modified by another writer.", e.UID)
+}
+
+// SQLDialect describes database specific syntax used by SQLSaveLoader.
+type SQLDialect struct {
+	Placeholder func(n int) string // n starts from 1
+	BlobType    string
+}
+
+func questionMark(n int) string {
+	return "?"
+}
+
+func dollarSign(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+// Predefined dialects.
+var (
+	SQLite     = SQLDialect{questionMark, "BLOB"}
+	MySQL      = SQLDialect{questionMark, "BLOB"}
+	PostgreSQL = SQLDialect{dollarSign, "BYTEA"}
+)
+
+// SQLSaveLoader stores state in database/sql, with optimistic concurrency control.
+// State id is also stored in column sid, so users can be queried by state, but
+// Load decodes it from data.
+//
+// Each row carries a version number. Save only succeeds if the version is
+// unchanged since last Load, or returns *ConflictError. It is safe to run
+// several bot instances against one database. On conflict, the message is
+// processed again with reloaded state, and actions run again: they must be
+// idempotent, or tolerate running twice.
+//
+// Versions of recently used users are cached, a Save without Load of a user
+// evicted from the cache conflicts, which is safe but causes a retry.
+//
+// It also implements TimerStore, storing timers in table named with "_timers"
+// suffix.
+type SQLSaveLoader struct {
+	db       *sql.DB
+	dialect  SQLDialect
+	table    string
+	codec    Codec
+	init     StateInitializer
+	lock     sync.Mutex
+	versions map[string]*list.Element
+	lru      *list.List // of *sqlVersion, most recently used first
+}
+
+type sqlVersion struct {
+	uid     string
+	version int64
+}
+
+// SQLStore creates a SQLSaveLoader using table. Call CreateTable to create
+// the table if you have not done it yet.
+func SQLStore(db *sql.DB, dialect SQLDialect, table string, codec Codec, init StateInitializer) *SQLSaveLoader {
+	return &SQLSaveLoader{
+		db:       db,
+		dialect:  dialect,
+		table:    table,
+		codec:    codec,
+		init:     init,
+		versions: make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// build replaces %s with table name and %N with N-th placeholder.
+func (s *SQLSaveLoader) build(query string, n int) string {
+	args := []interface{}{s.table}
+	for i := 1; i <= n; i++ {
+		args = append(args, s.dialect.Placeholder(i))
+	}
+	return fmt.Sprintf(query, args...)
+}
+
+// CreateTable creates the tables if not exist.
+func (s *SQLSaveLoader) CreateTable() error {
+	_, err := s.db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	uid VARCHAR(255) NOT NULL PRIMARY KEY,
+	sid VARCHAR(255) NOT NULL,
+	data %s,
+	version BIGINT NOT NULL,
+	updated_at TIMESTAMP NOT NULL
+)`, s.table, s.dialect.BlobType))
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s_timers (
+	uid VARCHAR(255) NOT NULL PRIMARY KEY,
+	from_sid VARCHAR(255) NOT NULL,
+	to_sid VARCHAR(255) NOT NULL,
+	deadline BIGINT NOT NULL,
+	data %s
+)`, s.table, s.dialect.BlobType))
+	return err
+}
+
+func (s *SQLSaveLoader) setVersion(uid string, version int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if elem, ok := s.versions[uid]; ok {
+		elem.Value.(*sqlVersion).version = version
+		s.lru.MoveToFront(elem)
+		return
+	}
+	s.versions[uid] = s.lru.PushFront(&sqlVersion{uid, version})
+	for s.lru.Len() > sqlVersionCache {
+		delete(s.versions, s.lru.Remove(s.lru.Back()).(*sqlVersion).uid)
+	}
+}
+
+// version returns cached version of user, 0 if not cached.
+func (s *SQLSaveLoader) version(uid string) int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	elem, ok := s.versions[uid]
+	if !ok {
+		return 0
+	}
+	return elem.Value.(*sqlVersion).version
+}
+
+func (s *SQLSaveLoader) Load(uid string) (sid string, data interface{}, err error) {
+	var (
+		raw     []byte
+		version int64
+	)
+	err = s.db.QueryRow(
+		s.build(`SELECT data, version FROM %s WHERE uid = %s`, 1), uid,
+	).Scan(&raw, &version)
+	if err == sql.ErrNoRows {
+		s.setVersion(uid, 0)
+		return InitialState, s.init(uid), nil
+	}
+	if err != nil {
+		return
+	}
+
+	if sid, data, err = s.codec.Decode(bytes.NewReader(raw)); err != nil {
+		return
+	}
+	s.setVersion(uid, version)
+	return
+}
+
+func (s *SQLSaveLoader) Save(uid string, sid string, data interface{}) (err error) {
+	buf := new(bytes.Buffer)
+	if err = s.codec.Encode(buf, sid, data); err != nil {
+		return
+	}
+
+	version := s.version(uid)
+	if version == 0 {
+		// a user not cached is treated as new, and conflicts if exists
+		_, err = s.db.Exec(
+			s.build(`INSERT INTO %s (uid, sid, data, version, updated_at) VALUES (%s, %s, %s, 1, %s)`, 4),
+			uid, sid, buf.Bytes(), time.Now(),
+		)
+		if err != nil {
+			var cnt int
+			if s.db.QueryRow(s.build(`SELECT COUNT(*) FROM %s WHERE uid = %s`, 1), uid).Scan(&cnt) == nil && cnt > 0 {
+				err = &ConflictError{uid}
+			}
+			return
+		}
+		s.setVersion(uid, 1)
+		return
+	}
+
+	res, err := s.db.Exec(
+		s.build(`UPDATE %s SET sid = %s, data = %s, version = version + 1, updated_at = %s WHERE uid = %s AND version = %s`, 5),
+		sid, buf.Bytes(), time.Now(), uid, version,
+	)
+	if err != nil {
+		return
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return
+	}
+	if affected == 0 {
+		return &ConflictError{uid}
+	}
+	s.setVersion(uid, version+1)
+	return
+}
+
+// SaveTimer replaces timer of the user. Deadline is stored in nanoseconds, so
+// ClaimTimer compares it exactly.
+func (s *SQLSaveLoader) SaveTimer(uid string, t Timer) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(s.build(`DELETE FROM %s_timers WHERE uid = %s`, 1), uid); err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		s.build(`INSERT INTO %s_timers (uid, from_sid, to_sid, deadline, data) VALUES (%s, %s, %s, %s, %s)`, 5),
+		uid, t.From, t.To, t.Deadline.UnixNano(), data,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLSaveLoader) DeleteTimer(uid string) error {
+	_, err := s.db.Exec(s.build(`DELETE FROM %s_timers WHERE uid = %s`, 1), uid)
+	return err
+}
+
+// ClaimTimer deletes the row only if it still holds a timer with same states
+// and deadline, so only one of the replicas claims it.
+func (s *SQLSaveLoader) ClaimTimer(uid string, t Timer) (bool, error) {
+	res, err := s.db.Exec(
+		s.build(`DELETE FROM %s_timers WHERE uid = %s AND from_sid = %s AND to_sid = %s AND deadline = %s`, 4),
+		uid, t.From, t.To, t.Deadline.UnixNano(),
+	)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected == 1, err
+}
+
+func (s *SQLSaveLoader) LoadTimers() (ret []Timer, err error) {
+	rows, err := s.db.Query(s.build(`SELECT data FROM %s_timers`, 0))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			data []byte
+			t    Timer
+		)
+		if err = rows.Scan(&data); err != nil {
+			return
+		}
+		if err = json.Unmarshal(data, &t); err != nil {
+			return
+		}
+		ret = append(ret, t)
+	}
+	return ret, rows.Err()
+}
@@ -0,0 +1,143 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+// go-sqlite3 is not a dependency of the package, and needs cgo, run these
+// tests with "go test -tags sqlite".
+
+//go:build sqlite
+
+package botgoram
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/Patrolavia/telegram"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestSQLStoreConflict(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Cannot open sqlite: %s", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1) // every connection to :memory: is a new database
+
+	init := func(uid string) interface{} { return "init" }
+	replica1 := SQLStore(db, SQLite, "states", JSONCodec(), init)
+	replica2 := SQLStore(db, SQLite, "states", JSONCodec(), init)
+	if err := replica1.CreateTable(); err != nil {
+		t.Fatalf("Cannot create table: %s", err)
+	}
+
+	if sid, data, err := replica1.Load("user"); err != nil || sid != InitialState || data != "init" {
+		t.Fatalf("Expected initial state for new user, got state[%s] with data %v, err %v", sid, data, err)
+	}
+	replica2.Load("user")
+
+	// concurrent insert
+	if err := replica1.Save("user", "state1", "data1"); err != nil {
+		t.Fatalf("Cannot save: %s", err)
+	}
+	if err := replica2.Save("user", "state2", "data2"); err == nil {
+		t.Fatalf("Concurrent insert should conflict.")
+	} else if _, ok := err.(*ConflictError); !ok {
+		t.Fatalf("Expected ConflictError, got %s", err)
+	}
+
+	// concurrent update
+	replica1.Load("user")
+	replica2.Load("user")
+	if err := replica2.Save("user", "state2", "data2"); err != nil {
+		t.Fatalf("Cannot save: %s", err)
+	}
+	if _, ok := replica1.Save("user", "state1", "data1").(*ConflictError); !ok {
+		t.Fatalf("Concurrent update should conflict.")
+	}
+
+	// successive saves from same loader are fine
+	if err := replica2.Save("user", "state3", "data3"); err != nil {
+		t.Fatalf("Cannot save twice: %s", err)
+	}
+	sid, data, err := replica1.Load("user")
+	if err != nil || sid != "state3" || data != "data3" {
+		t.Errorf("Expected latest state, got state[%s] with data %v, err %v", sid, data, err)
+	}
+	if err := db.QueryRow("SELECT sid FROM states WHERE uid = ?", "user").Scan(&sid); err != nil || sid != "state3" {
+		t.Errorf("Expected state id in sid column, got %s, err %v", sid, err)
+	}
+}
+
+func TestSQLStoreTimers(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Cannot open sqlite: %s", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	store := SQLStore(db, SQLite, "states", JSONCodec(), func(uid string) interface{} { return nil })
+	if err := store.CreateTable(); err != nil {
+		t.Fatalf("Cannot create table: %s", err)
+	}
+
+	user := makeTestUser("user1")
+	deadline := time.Now().Add(time.Minute).Round(time.Second)
+	store.SaveTimer(user.Identifier(), Timer{user, "a", "b", deadline})
+	if err := store.SaveTimer(user.Identifier(), Timer{user, "a", "c", deadline}); err != nil {
+		t.Fatalf("Cannot replace timer: %s", err)
+	}
+	timers, err := store.LoadTimers()
+	if err != nil || len(timers) != 1 || timers[0].To != "c" || !timers[0].Deadline.Equal(deadline) || timers[0].User.ID != user.ID {
+		t.Fatalf("Expected replaced timer, got %#v, err %v", timers, err)
+	}
+
+	// another replica loaded the timer too, only one of them claims it
+	replica := SQLStore(db, SQLite, "states", JSONCodec(), func(uid string) interface{} { return nil })
+	stale := timers[0]
+	stale.To = "b"
+	if ok, err := replica.ClaimTimer(user.Identifier(), stale); ok || err != nil {
+		t.Errorf("Replaced timer should not be claimed, got %t, err %v", ok, err)
+	}
+	// claiming does not depend on how user is encoded
+	claimed := timers[0]
+	claimed.User = &telegram.Victim{ID: user.ID}
+	if ok, err := replica.ClaimTimer(user.Identifier(), claimed); !ok || err != nil {
+		t.Errorf("Expected timer claimed, got %t, err %v", ok, err)
+	}
+	if ok, _ := store.ClaimTimer(user.Identifier(), timers[0]); ok {
+		t.Errorf("Timer should be claimed only once")
+	}
+
+	store.SaveTimer(user.Identifier(), timers[0])
+	store.DeleteTimer(user.Identifier())
+	if timers, _ = store.LoadTimers(); len(timers) != 0 {
+		t.Errorf("Expected no timer after deleting, got %#v", timers)
+	}
+}
+
+func TestSQLStoreRecord(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Cannot open sqlite: %s", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	store := SQLStore(db, SQLite, "states", JSONCodec(), func(uid string) interface{} { return nil })
+	if err := store.CreateTable(); err != nil {
+		t.Fatalf("Cannot create table: %s", err)
+	}
+
+	store.Load("user")
+	if err := store.Save("user", "state", Record{"data", []string{"b", "a"}, []Frame{{"flow", "ret"}}}); err != nil {
+		t.Fatalf("Cannot save record: %s", err)
+	}
+	_, data, err := store.Load("user")
+	r, ok := data.(Record)
+	if err != nil || !ok || r.Data != "data" || len(r.History) != 2 || r.History[0] != "b" || len(r.Calls) != 1 || r.Calls[0] != (Frame{"flow", "ret"}) {
+		t.Errorf("Record does not round-trip, got %#v, err %v", data, err)
+	}
+}
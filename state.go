@@ -5,8 +5,8 @@ package botgoram
 
 import (
 	"errors"
-	"log"
-	"regexp"
+	"strings"
+	"time"
 
 	"github.com/Patrolavia/telegram"
 )
@@ -50,16 +50,6 @@ func msgType(msg *telegram.Message) string {
 	}
 }
 
-var commandSpliter *regexp.Regexp
-
-func init() {
-	cs, err := regexp.Compile(`^(\S+)(\s*.*)?$`)
-	if err != nil {
-		log.Fatalf("Cannot compile regular expression for spliting command, contact botgoram developer!")
-	}
-	commandSpliter = cs
-}
-
 // ErrNoMatch denotes the message does not match the transitor
 var ErrNoMatch = errors.New("No matching transitor!")
 
@@ -81,6 +71,16 @@ const InitialState = ""
 // no matter which type it is. These messages will fallback to message type
 // transitors when match failed.
 //
+// Callback queries, sent when user pressed a button of inline keyboard, are
+// matched only against callback transitors by prefix of the callback data. The
+// message passed to callback transitors is a copy of the message carrying the
+// keyboard, with sender replaced by who pressed the button. Use
+// State.CallbackQuery() to access the query itself. Callback queries matching
+// no transitor are ignored.
+//
+// Edited messages are matched only against edited transitors, and ignored if
+// there is no matching one.
+//
 // You should take care of not registering same transitor to a state twice, or
 // the transitor will be called twice when match failed.
 //
@@ -103,18 +103,107 @@ type State interface {
 	// Transit(id) anywhere before or after Retransit(), the state will
 	// transit to id, without testing any transitor.
 	Retransit()
+	// TransitAfter schedules a transition to state id after d, if user stays in
+	// this state until then. Call it in enter action. Entering any state cancels the
+	// schedule, including re-entering this state.
+	//
+	// The enter and leave actions run on timeout receive an empty message from
+	// the user, with Date set to the deadline.
+	TransitAfter(d time.Duration, id string)
+	// RegisterTimeout sets the default timeout of this state, which acts as
+	// calling TransitAfter(d, id) every time entering this state.
+	RegisterTimeout(d time.Duration, id string)
+	// OnError sets how to recover from errors returned by enter/leave action of
+	// this state. h is called first, and the user is transited to errorState if h
+	// returns nil. Either h or errorState can be empty. See ErrorHandler.
+	OnError(h ErrorHandler, errorState string)
+	// SetParent puts this state into the group of state id. Transitors of parent
+	// state are matched after the ones of this state, as fallbacks. Enter and
+	// leave actions of parent state run when the user enters or leaves the group
+	// from or to a state outside it, besides entering or leaving parent state itself.
+	SetParent(id string)
+	Parent() string // state id of parent state, empty if not in any group
+
+	// History returns previous states of the user, from the most recent one. It
+	// is always empty unless history is enabled by FSM.SetHistoryDepth.
+	//
+	// A state is pushed into history when leaving it for another state. Transiting
+	// to the same state, or from a state with history disabled, changes nothing.
+	History() []string
+	// Back transits to the state n steps back in history like Transit(id), and
+	// removes these steps from history. State data is not restored. It returns
+	// false and does nothing if there are less than n states in history.
+	//
+	// To go back in a transitor, call Back and return History()[n-1], or just use Back(n).
+	Back(n int) bool
+	// DisableHistory prevents this state from being pushed into history, like
+	// confirmation or error states.
+	DisableHistory()
+
+	// Call transits to entry state of subflow like Transit(id), and transits to
+	// returnState when the subflow returns. To call in a transitor, call Call and
+	// return flow as next state id, or just use Call(flow, returnState).
+	Call(flow, returnState string)
+	// Return finishes current subflow, transiting to return state of the caller
+	// like Transit(id). It returns false and does nothing if not in a subflow.
+	Return(result interface{}) bool
+	// Calls returns pending subflow calls, the innermost one last.
+	Calls() []Frame
+	// Result returns what the subflow returned, only available in enter action
+	// of the return state.
+	Result() interface{}
 
 	// register transitors by message types
 	Register(mt string, t Transitor)
 
 	// Command is a special text message type, will be matched before text type.
-	// A text message matches /^(\S+)(\s*.*)?$/ will go here before text type, and
-	// we use first matching group to find out which transitor to call, case-sensitive.
-	// (We use \S in regexp so you can define command in any language)
+	// A text message goes here before text type, and we use its first word to find
+	// out which transitor to call. (So you can define command in any language)
+	// See CommandParser for how bot username, case and aliases are handled.
 	RegisterCommand(cmd string, t Transitor)
+	// Command returns the command of message being processed, parsed by
+	// CommandParser. It is empty if the message is not text.
+	Command() string
+	// Args returns arguments of the command.
+	Args() []string
 
 	RegisterFallback(Transitor)
+
+	// RegisterForward registers transitor for forwarded messages, matched before
+	// any other transitor.
+	RegisterForward(t Transitor)
+	// RegisterReply registers transitor for replied messages, matched after
+	// forward transitors.
+	RegisterReply(t Transitor)
+
+	// RegisterCallback registers transitor for callback queries whose data starts with prefix.
+	// Empty prefix matches all callback queries.
+	RegisterCallback(prefix string, t Transitor)
+	// CallbackQuery returns the callback query being processed, nil when processing a message.
+	CallbackQuery() *telegram.CallbackQuery
+
+	// RegisterEdited registers transitor for edited messages.
+	RegisterEdited(t Transitor)
+	// Captures returns submatches of Regexp matcher, or arguments of Command
+	// matcher, which leads to this state.
+	Captures() []string
+
 	test(msg *telegram.Message) (next string, err error)
+	testCallback(msg *telegram.Message) (next string, err error)
+	testEdited(msg *telegram.Message) (next string, err error)
+	setCallbackQuery(q *telegram.CallbackQuery)
+	setCaptures(c []string)
+	setCommand(pc *parsedCommand)
+	parsed(msg *telegram.Message) *parsedCommand
+	delay() *delay
+	errorHandler() (h ErrorHandler, errorState string)
+	setHistory(h []string)
+	backSteps() int
+	recorded() bool
+	setCalls(calls []Frame)
+	calling() *Frame
+	returning() (result interface{}, ok bool)
+	setResult(result interface{})
 	clone(user *telegram.Victim) State
 	next() *string
 	re() bool
@@ -132,6 +221,11 @@ func (ts transitors) test(msg *telegram.Message, cur State) (next string, err er
 	return
 }
 
+type callbackTransitor struct {
+	prefix    string
+	transitor Transitor
+}
+
 type state struct {
 	data      interface{}
 	user      *telegram.Victim
@@ -142,8 +236,26 @@ type state struct {
 	command   map[string]transitors
 	text      transitors
 	fallback  transitors
+	callback  []callbackTransitor
+	edited    transitors
+	query     *telegram.CallbackQuery
+	captures  []string
+	cmdLine   *parsedCommand
+	cmdSet    bool
 	chain     *string
 	retransit bool
+	timeout   *delay
+	after     *delay
+	onError   ErrorHandler
+	errState  string
+	parent    string
+	history   []string
+	back      int
+	noHistory bool
+	calls     []Frame
+	call      *Frame
+	ret       bool
+	result    interface{}
 }
 
 func newState(id string) State {
@@ -168,6 +280,104 @@ func (s *state) re() bool {
 	return s.retransit
 }
 
+func (s *state) TransitAfter(d time.Duration, id string) {
+	s.after = &delay{d, id}
+}
+
+func (s *state) RegisterTimeout(d time.Duration, id string) {
+	s.timeout = &delay{d, id}
+}
+
+func (s *state) delay() *delay {
+	if s.after != nil {
+		return s.after
+	}
+	return s.timeout
+}
+
+func (s *state) OnError(h ErrorHandler, errorState string) {
+	s.onError, s.errState = h, errorState
+}
+
+func (s *state) errorHandler() (ErrorHandler, string) {
+	return s.onError, s.errState
+}
+
+func (s *state) SetParent(id string) {
+	s.parent = id
+}
+
+func (s *state) Parent() string {
+	return s.parent
+}
+
+func (s *state) History() []string {
+	return append([]string(nil), s.history...)
+}
+
+func (s *state) setHistory(h []string) {
+	s.history = h
+}
+
+func (s *state) Back(n int) bool {
+	if n <= 0 || n > len(s.history) {
+		return false
+	}
+	s.back = n
+	s.Transit(s.history[n-1])
+	return true
+}
+
+func (s *state) backSteps() int {
+	return s.back
+}
+
+func (s *state) DisableHistory() {
+	s.noHistory = true
+}
+
+func (s *state) recorded() bool {
+	return !s.noHistory
+}
+
+func (s *state) Call(flow, returnState string) {
+	s.call = &Frame{flow, returnState}
+	s.Transit(flow)
+}
+
+func (s *state) calling() *Frame {
+	return s.call
+}
+
+func (s *state) Return(result interface{}) bool {
+	if len(s.calls) == 0 {
+		return false
+	}
+	s.ret, s.result = true, result
+	s.Transit(s.calls[len(s.calls)-1].Return)
+	return true
+}
+
+func (s *state) returning() (interface{}, bool) {
+	return s.result, s.ret
+}
+
+func (s *state) Calls() []Frame {
+	return append([]Frame(nil), s.calls...)
+}
+
+func (s *state) setCalls(calls []Frame) {
+	s.calls = calls
+}
+
+func (s *state) Result() interface{} {
+	return s.result
+}
+
+func (s *state) setResult(result interface{}) {
+	s.result = result
+}
+
 func (s *state) Transit(id string) {
 	s.chain = &id
 }
@@ -208,29 +418,116 @@ func (s *state) RegisterCommand(cmd string, t Transitor) {
 	s.command[cmd] = append(s.command[cmd], t)
 }
 
+func (s *state) Command() string {
+	if s.cmdLine == nil {
+		return ""
+	}
+	return s.cmdLine.cmd
+}
+
+func (s *state) Args() []string {
+	if s.cmdLine == nil {
+		return nil
+	}
+	return s.cmdLine.args
+}
+
+func (s *state) setCommand(pc *parsedCommand) {
+	s.cmdLine, s.cmdSet = pc, true
+}
+
+// parsed returns parsed command of msg, parsing with default CommandParser if not set.
+func (s *state) parsed(msg *telegram.Message) *parsedCommand {
+	if !s.cmdSet && s.query == nil && msgType(msg) == TextMsg {
+		return CommandParser{}.parse(msg.Text)
+	}
+	return s.cmdLine
+}
+
 func (s *state) RegisterFallback(t Transitor) {
 	s.fallback = append(s.fallback, t)
 }
 
+func (s *state) RegisterCallback(prefix string, t Transitor) {
+	s.callback = append(s.callback, callbackTransitor{prefix, t})
+}
+
+func (s *state) CallbackQuery() *telegram.CallbackQuery {
+	return s.query
+}
+
+func (s *state) setCallbackQuery(q *telegram.CallbackQuery) {
+	s.query = q
+}
+
+func (s *state) testCallback(msg *telegram.Message) (next string, err error) {
+	return s.matchCallback(msg, s)
+}
+
+// matchCallback tests callback transitors against query of cur, passing cur to transitors.
+func (s *state) matchCallback(msg *telegram.Message, cur State) (next string, err error) {
+	err = ErrNoMatch
+	q := cur.CallbackQuery()
+	if q == nil {
+		return
+	}
+	for _, c := range s.callback {
+		if !strings.HasPrefix(q.Data, c.prefix) {
+			continue
+		}
+		if next, err = c.transitor(msg, cur); err == nil {
+			return
+		}
+	}
+	return next, ErrNoMatch
+}
+
+func (s *state) Captures() []string {
+	return s.captures
+}
+
+func (s *state) setCaptures(c []string) {
+	s.captures = c
+}
+
+func (s *state) RegisterEdited(t Transitor) {
+	s.edited = append(s.edited, t)
+}
+
+func (s *state) testEdited(msg *telegram.Message) (next string, err error) {
+	return s.edited.test(msg, s)
+}
+
 func (s *state) test(msg *telegram.Message) (next string, err error) {
+	return s.match(msg, s)
+}
+
+// matchCommand tests command transitors, passing cur to transitors.
+func (s *state) matchCommand(msg *telegram.Message, cur State) (next string, err error) {
+	err = ErrNoMatch
+	pc := cur.parsed(msg)
+	if pc == nil {
+		return
+	}
+	c, ok := lookup(s.command, pc.cmd, pc.fold)
+	if !ok || len(s.command[c]) == 0 {
+		return
+	}
+	return s.command[c].test(msg, cur)
+}
+
+// match tests transitors of s, passing cur to transitors.
+func (s *state) match(msg *telegram.Message, cur State) (next string, err error) {
+	return s.matchSkipping(msg, cur, false)
+}
+
+// matchSkipping is match, skipping command transitors if skipCommand is true.
+func (s *state) matchSkipping(msg *telegram.Message, cur State, skipCommand bool) (next string, err error) {
 	doTest := func(ts transitors) (next string, err error) {
 		if len(ts) == 0 {
 			return next, ErrNoMatch
 		}
-		return ts.test(msg, s)
-	}
-	// TODO: find better way to test commands.
-	testCmd := func() (next string, err error) {
-		err = ErrNoMatch
-		matches := commandSpliter.FindStringSubmatch(msg.Text)
-		if len(matches) != 3 {
-			return
-		}
-		cmd, ok := s.command[matches[1]]
-		if !ok {
-			return
-		}
-		return doTest(cmd)
+		return ts.test(msg, cur)
 	}
 
 	// process forwarded message and replied message
@@ -247,8 +544,8 @@ func (s *state) test(msg *telegram.Message) (next string, err error) {
 
 	mt := msgType(msg)
 	// process command message
-	if mt == TextMsg {
-		if next, err = testCmd(); err == nil {
+	if !skipCommand {
+		if next, err = s.matchCommand(msg, cur); err == nil {
 			return
 		}
 	}
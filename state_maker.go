@@ -3,6 +3,8 @@
 
 package botgoram
 
+import "time"
+
 // TransitorMap maps a transitor to parent state.
 type TransitorMap struct {
 	Transitor Transitor
@@ -11,9 +13,26 @@ type TransitorMap struct {
 	// It denotes a call to Transit(id).
 	IsHidden   bool
 	IsFallback bool // if this is a fallback transitor. matched second.
+	IsCallback bool // if this is a callback query transitor.
+	IsEdited   bool // if this is an edited message transitor.
+	IsForward  bool // if this is a forwarded message transitor.
+	IsReply    bool // if this is a replied message transitor.
+	IsGlobal   bool // if this is a global transitor, matched in every state. State is ignored.
 	Type       string
 	Command    string // ignored if it is empty string or Type is not TEXT.
-	Desc       string // only for state map generating.
+	Callback   string // callback data prefix, only used when IsCallback is true.
+	// If not zero, this is a timeout transitor: transit to this state if user
+	// stays in parent state for Timeout. Transitor is not used.
+	Timeout time.Duration
+	// If not empty, this transitor calls subflow Call, and returns to this state
+	// when the subflow finishes. Transitor acts as a guard, its next state id is
+	// ignored. Nil Transitor always matches.
+	Call string
+	// Match is used when Transitor is nil, transiting to this state if matched.
+	// It is registered according to other fields as usual, or according to Match
+	// if no flag, Type nor Command is set, e.g. Text(...) is a text transitor.
+	Match Matcher
+	Desc  string // only for state map generating.
 }
 
 // StateMaker helps you design you own state map by
@@ -23,3 +42,22 @@ type StateMaker interface {
 	Actions() (enter Action, leave Action)
 	Transitors() []TransitorMap
 }
+
+// ErrorRecoverer can be implemented by StateMaker to declare how to recover
+// from errors returned by its enter/leave actions. ErrorRecovery returns the
+// arguments to call State.OnError with.
+type ErrorRecoverer interface {
+	ErrorRecovery() (h ErrorHandler, errorState string)
+}
+
+// Nested can be implemented by StateMaker to put the state into the group of
+// another state. See State.SetParent.
+type Nested interface {
+	Parent() string
+}
+
+// Unrecorded can be implemented by StateMaker to keep the state out of history
+// if Unrecorded returns true. See State.DisableHistory.
+type Unrecorded interface {
+	Unrecorded() bool
+}
@@ -117,3 +117,62 @@ func TestTypeTransitors(t *testing.T) {
 		t.Errorf("While testing command transitor: not fallback to text, get next state %s", next)
 	}
 }
+
+func TestCallbackTransitors(t *testing.T) {
+	st := newState("")
+	factory := func(result string) Transitor {
+		return func(msg *telegram.Message, state State) (next string, err error) {
+			return result, nil
+		}
+	}
+	st.RegisterCallback("menu:", factory("menu"))
+	st.RegisterCallback("", factory("any"))
+	st.RegisterFallback(factory("fallback"))
+
+	msg := &telegram.Message{From: &telegram.Victim{}, Chat: &telegram.Victim{}}
+	if _, err := st.testCallback(msg); err != ErrNoMatch {
+		t.Errorf("Expected ErrNoMatch when testing message against callback transitors.")
+	}
+
+	st.setCallbackQuery(&telegram.CallbackQuery{Data: "menu:1"})
+	if next, _ := st.testCallback(msg); next != "menu" {
+		t.Errorf("While testing callback transitor: get next state %s", next)
+	}
+
+	st.setCallbackQuery(&telegram.CallbackQuery{Data: "other"})
+	if next, _ := st.testCallback(msg); next != "any" {
+		t.Errorf("While testing callback transitor with empty prefix: get next state %s", next)
+	}
+}
+
+func TestForwardReplyTransitors(t *testing.T) {
+	var st State = newState("")
+	factory := func(result string) Transitor {
+		return func(msg *telegram.Message, state State) (next string, err error) {
+			return result, nil
+		}
+	}
+	st.Register(TextMsg, factory(TextMsg))
+	st.RegisterForward(factory("forward"))
+	st.RegisterReply(factory("reply"))
+
+	msg := &telegram.Message{
+		From:        &telegram.Victim{},
+		Chat:        &telegram.Victim{},
+		ForwardFrom: &telegram.Victim{},
+		ReplyTo:     &telegram.Message{},
+	}
+	if next, _ := st.test(msg); next != "forward" {
+		t.Errorf("While testing forward transitor: get next state %s", next)
+	}
+
+	msg.ForwardFrom = nil
+	if next, _ := st.test(msg); next != "reply" {
+		t.Errorf("While testing reply transitor: get next state %s", next)
+	}
+
+	msg.ReplyTo = nil
+	if next, _ := st.test(msg); next != TextMsg {
+		t.Errorf("While testing text transitor: get next state %s", next)
+	}
+}
@@ -3,71 +3,172 @@
 
 package botgoram
 
-import "github.com/Patrolavia/godot"
+import (
+	"sort"
+	"strings"
+)
+
+// Renderer renders Graph in some diagram format.
+type Renderer interface {
+	Render(g *Graph) string
+}
+
+// Predefined renderers.
+var (
+	Graphviz Renderer = dotRenderer{}
+	Mermaid  Renderer = mermaidRenderer{}
+	PlantUML Renderer = plantUMLRenderer{}
+)
 
 func (f *fsm) StateMap(name string) (dot string) {
-	fix := func(n string) string {
-		if n == "" {
-			return name
+	return f.RenderStateMap(name, Graphviz)
+}
+
+func (f *fsm) RenderStateMap(name string, r Renderer) string {
+	return r.Render(f.Graph(name))
+}
+
+// cluster is a group of states drawn as subgraph.
+type cluster struct {
+	id       string
+	label    string
+	state    string // the parent state, empty for subflow
+	states   []string
+	children []*cluster
+}
+
+// clusters groups states by their parent states and subflows, returning
+// top-level clusters. Top-level groups in subflow are put into cluster of subflow.
+func clusters(g *Graph) (ret []*cluster) {
+	groups := make(map[string]*cluster)
+	for _, st := range g.States {
+		if st.Parent != "" && groups[st.Parent] == nil {
+			groups[st.Parent] = &cluster{id: g.Display(st.Parent), label: g.Display(st.Parent), state: st.Parent}
 		}
-		return n
 	}
-	add := func(a, b string) string {
-		if a != "" {
-			b = a + `\n` + b
+	flows := make(map[string]*cluster)
+	var flowOrder []string
+	flow := func(name string) *cluster {
+		c, ok := flows[name]
+		if !ok {
+			c = &cluster{id: "flow_" + name, label: "subflow: " + name}
+			flows[name] = c
+			flowOrder = append(flowOrder, name)
 		}
-		return b
+		return c
 	}
-	g := godot.NewGraph(false, true, "StateMap", nil)
-	nodes := make(map[string]godot.Node)
-	nodes[name] = g.AddNode(name, map[string]string{"fillcolor": "#ccccff", "style": "filled"})
-	node := func(n string) godot.Node {
-		ret, ok := nodes[n]
-		if !ok { // undocumented state, warning user by draw it red
-			ret = g.AddNode(n, map[string]string{"bgcolor": "red"})
-			nodes[n] = ret
+
+	for _, st := range g.States {
+		switch c, isGroup := groups[st.ID]; {
+		case isGroup:
+			if p, ok := groups[st.Parent]; ok {
+				p.children = append(p.children, c)
+			} else if st.Flow != "" {
+				flow(st.Flow).children = append(flow(st.Flow).children, c)
+			} else {
+				ret = append(ret, c)
+			}
+		case st.Parent != "":
+			groups[st.Parent].states = append(groups[st.Parent].states, st.ID)
+		case st.Flow != "":
+			flow(st.Flow).states = append(flow(st.Flow).states, st.ID)
 		}
-		return ret
 	}
+	for _, name := range flowOrder {
+		ret = append(ret, flows[name])
+	}
+	return
+}
+
+type dotRenderer struct{}
 
-	for _, s := range f.sm {
-		n := fix(s.Name())
-		opt := make(map[string]string)
-		label := n
-		enter, leave := s.Actions()
-		if enter != nil {
-			label += `\n------------\n` + "enter action"
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// dotQuote quotes s as DOT string. Backslashes are escaped as graphviz treats
+// them as escape sequences in labels, and newlines become line breaks.
+func dotQuote(s string) string {
+	return `"` + dotEscaper.Replace(s) + `"`
+}
+
+// dotAttrs formats attributes, sorted by name.
+func dotAttrs(attrs map[string]string) string {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		keys[i] = k + "=" + dotQuote(attrs[k])
+	}
+	return " [" + strings.Join(keys, ", ") + "]"
+}
+
+func (dotRenderer) Render(sm *Graph) string {
+	var buf strings.Builder
+	buf.WriteString("digraph StateMap {\n")
+	known := make(map[string]bool)
+	for _, st := range sm.States {
+		known[st.ID] = true
+		label := sm.Display(st.ID)
+		if st.Enter {
+			label += "\n------------\nenter action"
+		}
+		if st.Leave {
+			label += "\n------------\nleave action"
 		}
-		if leave != nil {
-			label += `\n------------\n` + "leave action"
+		attrs := map[string]string{"label": label}
+		switch {
+		case st.ID == InitialState:
+			attrs["fillcolor"], attrs["style"] = "#ccccff", "filled"
+		case st.Undocumented: // warning user by draw it red
+			attrs["bgcolor"] = "red"
 		}
-		opt["label"] = label
-		nodes[n] = g.AddNode(n, opt)
+		buf.WriteString("\t" + dotQuote(sm.Display(st.ID)) + dotAttrs(attrs) + ";\n")
 	}
 
-	for _, s := range f.sm {
-		n := fix(s.Name())
-		for _, t := range s.Transitors() {
-			n := n
-			m := fix(t.State)
-			opt := make(map[string]string)
-			label := t.Desc
-			switch {
-			case t.IsHidden:
-				opt["style"] = "dotted"
-				n, m = m, n
-			case t.IsFallback:
-				label = add(label, "fallback")
-			case t.Command != "" && t.Type == TextMsg:
-				label = add(label, "Command: "+t.Command)
-			default:
-				label = add(label, t.Type)
-			}
-			opt["label"] = label
-
-			g.AddEdge([]godot.Node{node(m), node(n)}, opt)
+	global := false
+	for _, e := range sm.Edges {
+		if e.From == AnyState && !global {
+			// all global transitors start from this node
+			global = true
+			buf.WriteString("\t" + dotQuote(AnyState) + dotAttrs(map[string]string{"label": "any state", "shape": "box", "style": "dashed"}) + ";\n")
 		}
+		attrs := map[string]string{"label": strings.Join(e.Lines(), "\n")}
+		switch e.Kind {
+		case HiddenEdge:
+			attrs["style"] = "dotted"
+		case TimeoutEdge, ReturnEdge:
+			attrs["style"] = "dashed"
+		case ErrorEdge:
+			attrs["color"] = "red"
+		}
+		buf.WriteString("\t" + dotQuote(sm.Display(e.From)) + " -> " + dotQuote(sm.Display(e.To)) + dotAttrs(attrs) + ";\n")
 	}
 
-	return g.String()
+	var write func(c *cluster, indent string)
+	write = func(c *cluster, indent string) {
+		buf.WriteString(indent + "subgraph " + dotQuote("cluster_"+c.id) + " {\n")
+		buf.WriteString(indent + "\tlabel=" + dotQuote(c.label) + ";\n")
+		states := c.states
+		if known[c.state] {
+			states = append([]string{c.state}, states...)
+		}
+		for _, id := range states {
+			buf.WriteString(indent + "\t" + dotQuote(sm.Display(id)) + ";\n")
+		}
+		for _, child := range c.children {
+			write(child, indent+"\t")
+		}
+		buf.WriteString(indent + "}\n")
+	}
+	cs := clusters(sm)
+	if global {
+		// global transitors are drawn once, from a node shared by all states
+		cs = append(cs, &cluster{id: "global", label: "global transitors", states: []string{AnyState}})
+	}
+	for _, c := range cs {
+		write(c, "\t")
+	}
+	buf.WriteString("}\n")
+	return buf.String()
 }
@@ -0,0 +1,107 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"fmt"
+
+	"github.com/Patrolavia/telegram"
+)
+
+// Subflow is a reusable set of states, like asking and confirming phone number,
+// which can be called from any state by State.Call.
+//
+// State ids of a subflow share the namespace with other states, while Name of a
+// subflow must not be used as state id.
+type Subflow struct {
+	Name   string
+	Entry  string // state id entered when called
+	States []StateMaker
+}
+
+// Frame is a pending subflow call of a user.
+type Frame struct {
+	Flow   string
+	Return string // state id returned to when subflow finishes
+}
+
+// Call returns a transitor calling subflow, returning to state returnState when
+// subflow finishes. See State.Call.
+func Call(flow, returnState string) Transitor {
+	return func(msg *telegram.Message, state State) (string, error) {
+		state.Call(flow, returnState)
+		return flow, nil
+	}
+}
+
+// callTransitor calls flow if guard matches, used by TransitorMap.Call.
+func callTransitor(guard Transitor, flow, returnState string) Transitor {
+	call := Call(flow, returnState)
+	if guard == nil {
+		return call
+	}
+	return func(msg *telegram.Message, state State) (string, error) {
+		if _, err := guard(msg, state); err != nil {
+			return "", err
+		}
+		return call(msg, state)
+	}
+}
+
+func (f *fsm) AddSubflow(flow Subflow) error {
+	if _, ok := f.flows[flow.Name]; ok {
+		return fmt.Errorf("Subflow %s is already added.", flow.Name)
+	}
+	if _, ok := f.states[flow.Name]; ok {
+		return fmt.Errorf("Subflow name %s is used as state id.", flow.Name)
+	}
+
+	for _, sm := range flow.States {
+		if sm.Name() == flow.Name {
+			return fmt.Errorf("Subflow name %s is used as state id.", flow.Name)
+		}
+	}
+	for _, sm := range flow.States {
+		if _, err := f.MakeState(sm); err != nil {
+			return err
+		}
+	}
+	if _, ok := f.states[flow.Entry]; !ok {
+		return fmt.Errorf("Cannot find entry state[%s] of subflow %s", flow.Entry, flow.Name)
+	}
+	f.flows[flow.Name] = flow
+	return nil
+}
+
+func (f *fsm) Subflow(name string) (flow Subflow, ok bool) {
+	flow, ok = f.flows[name]
+	return
+}
+
+// resolve returns the state to enter when transiting from current to id, which
+// might be a subflow.
+func (f *fsm) resolve(current State, id string) (string, error) {
+	call := current.calling()
+	if call == nil || call.Flow != id {
+		return id, nil
+	}
+	flow, ok := f.flows[id]
+	if !ok {
+		return id, fmt.Errorf("Cannot find subflow %s called from state[%s]", id, current.ID())
+	}
+	return flow.Entry, nil
+}
+
+// nextCalls computes calls after transiting from current to state id, and the
+// result returned by subflow if any.
+func (f *fsm) nextCalls(current State, id string) (calls []Frame, result interface{}) {
+	calls = current.Calls()
+	if call := current.calling(); call != nil && f.flows[call.Flow].Entry == id {
+		return append(calls, *call), nil
+	}
+	if ret, ok := current.returning(); ok && len(calls) > 0 && calls[len(calls)-1].Return == id {
+		return calls[:len(calls)-1], ret
+	}
+	return calls, nil
+}
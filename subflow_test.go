@@ -0,0 +1,91 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Patrolavia/telegram"
+)
+
+type flowState struct {
+	name  string
+	enter Action
+	trans []TransitorMap
+}
+
+func (s flowState) Name() string                   { return s.name }
+func (s flowState) Actions() (enter, leave Action) { return s.enter, nil }
+func (s flowState) Transitors() []TransitorMap     { return s.trans }
+
+func TestSubflow(t *testing.T) {
+	u := makeTestUser("user1")
+	ch := make(chan *telegram.Message)
+	store := MemoryStore(func(uid string) interface{} { return "" })
+	f := NewBySender(nil, store, 1, ch)
+
+	var calls []Frame
+	err := f.AddSubflow(Subflow{"phone", "phone.ask", []StateMaker{
+		flowState{"phone.ask", func(msg *telegram.Message, current State, api telegram.API) error {
+			calls = current.Calls()
+			return nil
+		}, nil},
+		flowState{"phone.done", func(msg *telegram.Message, current State, api telegram.API) error {
+			if !current.Return(msg.Text) {
+				t.Errorf("Return should succeed in subflow")
+			}
+			return nil
+		}, []TransitorMap{{State: "phone.ask", Type: TextMsg, Transitor: func(msg *telegram.Message, state State) (string, error) {
+			return "phone.done", nil
+		}}}},
+	}})
+	if err != nil {
+		t.Fatalf("Cannot add subflow: %s", err)
+	}
+
+	var result interface{}
+	f.MakeState(flowState{"order", func(msg *telegram.Message, current State, api telegram.API) error {
+		result = current.Result()
+		if len(current.Calls()) != 0 {
+			t.Errorf("Expected no pending call after return, got %v", current.Calls())
+		}
+		return nil
+	}, []TransitorMap{{State: InitialState, Type: TextMsg, Command: "/order", Call: "phone"}}})
+
+	if dot := f.StateMap("start"); !strings.Contains(dot, `subgraph "cluster_flow_phone"`) {
+		t.Errorf("Expected subflow drawn as cluster, got %s", dot)
+	}
+
+	go f.Start(0)
+	ch <- &telegram.Message{ID: 1, Text: "/order", From: u, Chat: u}
+	ch <- &telegram.Message{ID: 2, Text: "0912345678", From: u, Chat: u}
+	stopFSM(t, f)
+
+	if len(calls) != 1 || calls[0] != (Frame{"phone", "order"}) {
+		t.Errorf("Unexpected calls in subflow: %v", calls)
+	}
+	if result != "0912345678" {
+		t.Errorf("Expected result of subflow, got %v", result)
+	}
+	if sid, _, _ := store.Load(u.Identifier()); sid != "order" {
+		t.Errorf("Expected user returns to order, got state[%s]", sid)
+	}
+}
+
+func TestSubflowNameCollision(t *testing.T) {
+	f := NewBySender(nil, MemoryStore(nil), 1, make(chan *telegram.Message))
+	if err := f.AddSubflow(Subflow{"flow", "entry", []StateMaker{flowState{"entry", nil, nil}}}); err != nil {
+		t.Fatalf("Cannot add subflow: %s", err)
+	}
+	if _, err := f.MakeState(flowState{"flow", nil, nil}); err == nil {
+		t.Errorf("Making state named as subflow should fail.")
+	}
+	if _, err := f.AddState("flow", nil, nil); err == nil {
+		t.Errorf("Adding state named as subflow should fail.")
+	}
+	if err := f.AddSubflow(Subflow{"self", "self", []StateMaker{flowState{"self", nil, nil}}}); err == nil {
+		t.Errorf("Subflow with state named as itself should fail.")
+	}
+}
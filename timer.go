@@ -0,0 +1,100 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Patrolavia/telegram"
+)
+
+// Timer is a scheduled transition: transit user from state From to state To at
+// Deadline, if user is still in From.
+type Timer struct {
+	User     *telegram.Victim
+	From     string
+	To       string
+	Deadline time.Time
+}
+
+// TimerStore is implemented by durable SaveLoaders which can persist timers.
+// FSM loads timers from it when Start, so scheduled transitions survive restart.
+//
+// There is at most one timer for a user.
+//
+// Several FSMs sharing a TimerStore all load the timers, ClaimTimer makes sure
+// only one of them fires each timer.
+type TimerStore interface {
+	SaveTimer(uid string, t Timer) error
+	DeleteTimer(uid string) error
+	LoadTimers() ([]Timer, error)
+	// ClaimTimer deletes timer t of user atomically, and reports whether it was
+	// there: false means it has been claimed, replaced or deleted by others.
+	ClaimTimer(uid string, t Timer) (bool, error)
+}
+
+type delay struct {
+	duration time.Duration
+	id       string
+}
+
+type scheduled struct {
+	timer *Timer
+	t     *time.Timer
+}
+
+type scheduler struct {
+	lock   sync.Mutex
+	timers map[string]scheduled
+	fire   func(*Timer)
+}
+
+func newScheduler(fire func(*Timer)) *scheduler {
+	return &scheduler{
+		timers: make(map[string]scheduled),
+		fire:   fire,
+	}
+}
+
+// set replaces the timer of user.
+func (s *scheduler) set(uid string, timer *Timer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if old, ok := s.timers[uid]; ok {
+		old.t.Stop()
+	}
+	s.timers[uid] = scheduled{
+		timer,
+		time.AfterFunc(timer.Deadline.Sub(time.Now()), func() { s.fire(timer) }),
+	}
+}
+
+// cancel removes timer of the user, returns false if there is no timer.
+func (s *scheduler) cancel(uid string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	old, ok := s.timers[uid]
+	if ok {
+		old.t.Stop()
+		delete(s.timers, uid)
+	}
+	return ok
+}
+
+// current returns timer of the user, nil if none.
+func (s *scheduler) current(uid string) *Timer {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.timers[uid].timer
+}
+
+// stop stops all timers without removing them.
+func (s *scheduler) stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, t := range s.timers {
+		t.t.Stop()
+	}
+}
@@ -0,0 +1,131 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Patrolavia/telegram"
+)
+
+// waitState polls store until user is in state sid, or timeout.
+func waitState(store SaveLoader, uid, sid string, timeout time.Duration) (actual string) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if actual, _, _ = store.Load(uid); actual == sid {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return
+}
+
+func makeTimeoutFSM(store SaveLoader, ch chan *telegram.Message, enter Action) FSM {
+	f := NewBySender(nil, store, 1, ch)
+	f.AddState("ask", enter, nil)
+	f.AddState("answered", nil, nil)
+	f.AddState("gone", nil, nil)
+	init, _ := f.State(InitialState)
+	init.RegisterFallback(func(msg *telegram.Message, state State) (string, error) {
+		return "ask", nil
+	})
+	ask, _ := f.State("ask")
+	ask.RegisterFallback(func(msg *telegram.Message, state State) (string, error) {
+		return "answered", nil
+	})
+	return f
+}
+
+func stopFSM(t *testing.T, f FSM) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := f.Stop(ctx); err != nil {
+		t.Fatalf("Unexpected error when stopping fsm: %s", err)
+	}
+}
+
+func TestStateTimeout(t *testing.T) {
+	u1 := makeTestUser("user1")
+	ch := make(chan *telegram.Message)
+	store := MemoryStore(func(uid string) interface{} { return nil })
+	f := makeTimeoutFSM(store, ch, nil)
+	ask, _ := f.State("ask")
+	ask.RegisterTimeout(50*time.Millisecond, "gone")
+	timeouts := make(chan *Timer, 1)
+	f.Use(func(next Handler) Handler {
+		return func(u Update, current State, api telegram.API) (State, error) {
+			if u.Kind == UpdateTimeout {
+				timeouts <- u.Timer
+			}
+			return next(u, current, api)
+		}
+	})
+
+	go f.Start(0)
+	defer stopFSM(t, f)
+	ch <- &telegram.Message{ID: 1, Text: "test", From: u1, Chat: u1}
+
+	if sid := waitState(store, u1.Identifier(), "gone", 2*time.Second); sid != "gone" {
+		t.Errorf("Expected transit to gone after timeout, got state[%s]", sid)
+	}
+	if timer := <-timeouts; timer.From != "ask" || timer.To != "gone" {
+		t.Errorf("Expected middleware sees timeout from ask to gone, got %#v", timer)
+	}
+}
+
+func TestTransitAfterCancelled(t *testing.T) {
+	u1 := makeTestUser("user1")
+	ch := make(chan *telegram.Message)
+	store := MemoryStore(func(uid string) interface{} { return nil })
+	f := makeTimeoutFSM(store, ch, func(msg *telegram.Message, current State, api telegram.API) error {
+		current.TransitAfter(100*time.Millisecond, "gone")
+		return nil
+	})
+
+	go f.Start(0)
+	defer stopFSM(t, f)
+	ch <- &telegram.Message{ID: 1, Text: "test", From: u1, Chat: u1}
+	ch <- &telegram.Message{ID: 2, Text: "answer", From: u1, Chat: u1}
+
+	time.Sleep(300 * time.Millisecond)
+	if sid, _, _ := store.Load(u1.Identifier()); sid != "answered" {
+		t.Errorf("Timer should be cancelled when leaving state, got state[%s]", sid)
+	}
+}
+
+func TestTimerSurvivesRestart(t *testing.T) {
+	u1 := makeTestUser("user1")
+	store, _ := FileStore(t.TempDir(), JSONCodec(), func(uid string) interface{} { return nil })
+	enter := func(msg *telegram.Message, current State, api telegram.API) error {
+		current.TransitAfter(200*time.Millisecond, "gone")
+		return nil
+	}
+
+	ch := make(chan *telegram.Message)
+	f := makeTimeoutFSM(store, ch, enter)
+	go f.Start(0)
+	ch <- &telegram.Message{ID: 1, Text: "test", From: u1, Chat: u1}
+	stopFSM(t, f)
+	if timers, _ := store.(TimerStore).LoadTimers(); len(timers) != 1 || timers[0].To != "gone" {
+		t.Fatalf("Expected timer to be persisted, got %#v", timers)
+	}
+
+	// restart
+	f = makeTimeoutFSM(store, make(chan *telegram.Message), enter)
+	go f.Start(0)
+	defer stopFSM(t, f)
+	if sid := waitState(store, u1.Identifier(), "gone", 2*time.Second); sid != "gone" {
+		t.Fatalf("Expected transit to gone after restart, got state[%s]", sid)
+	}
+	timers, _ := store.(TimerStore).LoadTimers()
+	for deadline := time.Now().Add(time.Second); len(timers) != 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		timers, _ = store.(TimerStore).LoadTimers()
+	}
+	if len(timers) != 0 {
+		t.Errorf("Fired timer should be deleted, got %#v", timers)
+	}
+}
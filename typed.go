@@ -0,0 +1,303 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"fmt"
+
+	"github.com/Patrolavia/telegram"
+)
+
+// TypedState wraps State so state data is of type T.
+//
+// Data() returns zero value of T if state data is not a T, which only happens
+// when you mix typed and untyped code.
+type TypedState[T any] struct {
+	State
+}
+
+func (s TypedState[T]) Data() T {
+	ret, _ := s.State.Data().(T)
+	return ret
+}
+
+func (s TypedState[T]) SetData(data T) {
+	s.State.SetData(data)
+}
+
+// Register is State.Register with typed transitor.
+func (s TypedState[T]) Register(mt string, t TypedTransitor[T]) {
+	s.State.Register(mt, t.Untyped())
+}
+
+// RegisterCommand is State.RegisterCommand with typed transitor.
+func (s TypedState[T]) RegisterCommand(cmd string, t TypedTransitor[T]) {
+	s.State.RegisterCommand(cmd, t.Untyped())
+}
+
+// RegisterFallback is State.RegisterFallback with typed transitor.
+func (s TypedState[T]) RegisterFallback(t TypedTransitor[T]) {
+	s.State.RegisterFallback(t.Untyped())
+}
+
+// RegisterForward is State.RegisterForward with typed transitor.
+func (s TypedState[T]) RegisterForward(t TypedTransitor[T]) {
+	s.State.RegisterForward(t.Untyped())
+}
+
+// RegisterReply is State.RegisterReply with typed transitor.
+func (s TypedState[T]) RegisterReply(t TypedTransitor[T]) {
+	s.State.RegisterReply(t.Untyped())
+}
+
+// RegisterCallback is State.RegisterCallback with typed transitor.
+func (s TypedState[T]) RegisterCallback(prefix string, t TypedTransitor[T]) {
+	s.State.RegisterCallback(prefix, t.Untyped())
+}
+
+// RegisterEdited is State.RegisterEdited with typed transitor.
+func (s TypedState[T]) RegisterEdited(t TypedTransitor[T]) {
+	s.State.RegisterEdited(t.Untyped())
+}
+
+// TypedAction is Action with typed state data.
+type TypedAction[T any] func(msg *telegram.Message, current TypedState[T], api telegram.API) error
+
+// Untyped converts typed action to Action. nil is converted to nil.
+func (a TypedAction[T]) Untyped() Action {
+	if a == nil {
+		return nil
+	}
+	return func(msg *telegram.Message, current State, api telegram.API) error {
+		return a(msg, TypedState[T]{current}, api)
+	}
+}
+
+// TypedTransitor is Transitor with typed state data.
+type TypedTransitor[T any] func(msg *telegram.Message, state TypedState[T]) (next string, err error)
+
+// Untyped converts typed transitor to Transitor. nil is converted to nil.
+func (t TypedTransitor[T]) Untyped() Transitor {
+	if t == nil {
+		return nil
+	}
+	return func(msg *telegram.Message, state State) (string, error) {
+		return t(msg, TypedState[T]{state})
+	}
+}
+
+// TypedStateInitializer is StateInitializer returning typed data.
+type TypedStateInitializer[T any] func(uid string) T
+
+// Untyped converts typed initializer to StateInitializer.
+func (i TypedStateInitializer[T]) Untyped() StateInitializer {
+	return func(uid string) interface{} {
+		return i(uid)
+	}
+}
+
+// TypedTransitorMap is TransitorMap with typed transitor.
+// Transitor of the embedded TransitorMap is ignored.
+type TypedTransitorMap[T any] struct {
+	TransitorMap
+	Transitor TypedTransitor[T]
+}
+
+// Untyped converts typed transitor map to TransitorMap.
+func (m TypedTransitorMap[T]) Untyped() TransitorMap {
+	ret := m.TransitorMap
+	ret.Transitor = m.Transitor.Untyped()
+	return ret
+}
+
+// TypedStateMaker is StateMaker with typed actions and transitors.
+type TypedStateMaker[T any] interface {
+	Name() string
+	Actions() (enter TypedAction[T], leave TypedAction[T])
+	Transitors() []TypedTransitorMap[T]
+}
+
+type typedStateMaker[T any] struct {
+	TypedStateMaker[T]
+}
+
+// UntypedStateMaker converts typed state maker to StateMaker, like for
+// Subflow.States. Optional interfaces of sm are kept.
+func UntypedStateMaker[T any](sm TypedStateMaker[T]) StateMaker {
+	return typedStateMaker[T]{sm}
+}
+
+// TypedSubflow is Subflow of typed states.
+type TypedSubflow[T any] struct {
+	Name   string
+	Entry  string
+	States []TypedStateMaker[T]
+}
+
+// Untyped converts typed subflow to Subflow.
+func (flow TypedSubflow[T]) Untyped() Subflow {
+	ret := Subflow{flow.Name, flow.Entry, make([]StateMaker, len(flow.States))}
+	for i, sm := range flow.States {
+		ret.States[i] = UntypedStateMaker(sm)
+	}
+	return ret
+}
+
+// TypedGuard is Guard with typed state data.
+func TypedGuard[T any](desc string, f func(msg *telegram.Message, state TypedState[T]) bool) Matcher {
+	return Guard(desc, func(msg *telegram.Message, state State) bool {
+		return f(msg, TypedState[T]{state})
+	})
+}
+
+func (m typedStateMaker[T]) unwrap() interface{} {
+	return m.TypedStateMaker
+}
+
+func (m typedStateMaker[T]) Actions() (Action, Action) {
+	enter, leave := m.TypedStateMaker.Actions()
+	return enter.Untyped(), leave.Untyped()
+}
+
+func (m typedStateMaker[T]) Transitors() []TransitorMap {
+	typed := m.TypedStateMaker.Transitors()
+	ret := make([]TransitorMap, len(typed))
+	for i, t := range typed {
+		ret[i] = t.Untyped()
+	}
+	return ret
+}
+
+// TypedSaveLoader is SaveLoader with typed state data.
+type TypedSaveLoader[T any] interface {
+	Save(uid string, sid string, data T) error
+	Load(uid string) (sid string, data T, err error)
+}
+
+type typedStore[T any] struct {
+	SaveLoader
+}
+
+// TypedStore wraps a SaveLoader, asserting loaded data is of type T.
+func TypedStore[T any](sl SaveLoader) TypedSaveLoader[T] {
+	return typedStore[T]{sl}
+}
+
+// TypedMemoryStore is MemoryStore with typed state data.
+func TypedMemoryStore[T any](init TypedStateInitializer[T]) TypedSaveLoader[T] {
+	return TypedStore[T](MemoryStore(init.Untyped()))
+}
+
+func (s typedStore[T]) Save(uid string, sid string, data T) error {
+	return s.SaveLoader.Save(uid, sid, data)
+}
+
+func (s typedStore[T]) Load(uid string) (sid string, data T, err error) {
+	sid, raw, err := s.load(uid)
+	raw, _, _ = record(raw)
+	data, _ = raw.(T)
+	return
+}
+
+// load loads state data and checks its type, keeping Record as is.
+func (s typedStore[T]) load(uid string) (sid string, data interface{}, err error) {
+	sid, data, err = s.SaveLoader.Load(uid)
+	raw, _, _ := record(data)
+	if err != nil || raw == nil {
+		return
+	}
+	if typed, ok := raw.(T); !ok {
+		err = fmt.Errorf("State data of user#%s is %T, not %T.", uid, raw, typed)
+	}
+	return
+}
+
+type untypedStore[T any] struct {
+	TypedSaveLoader[T]
+}
+
+// UntypedStore converts TypedSaveLoader back to SaveLoader.
+// Save returns error if data is not of type T.
+func UntypedStore[T any](sl TypedSaveLoader[T]) SaveLoader {
+	return untypedStore[T]{sl}
+}
+
+// unwrap exposes optional interfaces like TimerStore of wrapped SaveLoader.
+func (s untypedStore[T]) unwrap() interface{} {
+	if t, ok := s.TypedSaveLoader.(typedStore[T]); ok {
+		return t.SaveLoader
+	}
+	return s.TypedSaveLoader
+}
+
+// Save saves Record through SaveLoader wrapped by TypedStore, other
+// TypedSaveLoaders cannot save history and subflow calls.
+func (s untypedStore[T]) Save(uid string, sid string, data interface{}) error {
+	raw, history, calls := record(data)
+	typed, ok := raw.(T)
+	if !ok && raw != nil {
+		return fmt.Errorf("State data of user#%s is %T, not %T.", uid, raw, typed)
+	}
+	if len(history) == 0 && len(calls) == 0 {
+		return s.TypedSaveLoader.Save(uid, sid, typed)
+	}
+	t, ok := s.TypedSaveLoader.(typedStore[T])
+	if !ok {
+		return fmt.Errorf("Cannot save history and subflow calls of user#%s with %T.", uid, s.TypedSaveLoader)
+	}
+	return t.SaveLoader.Save(uid, sid, Record{typed, history, calls})
+}
+
+func (s untypedStore[T]) Load(uid string) (sid string, data interface{}, err error) {
+	if t, ok := s.TypedSaveLoader.(typedStore[T]); ok {
+		return t.load(uid)
+	}
+	return s.TypedSaveLoader.Load(uid)
+}
+
+// TypedFSM wraps FSM so state data is of type T in every action, transitor and SaveLoader.
+type TypedFSM[T any] struct {
+	FSM
+}
+
+// NewTypedBySender creates a TypedFSM associates with message sender. See NewBySender.
+func NewTypedBySender[T any](api telegram.API, sl TypedSaveLoader[T], size int, msgs chan *telegram.Message) *TypedFSM[T] {
+	return &TypedFSM[T]{NewBySender(api, UntypedStore(sl), size, msgs)}
+}
+
+// NewTypedByChat creates a TypedFSM associates with chatroom. See NewByChat.
+func NewTypedByChat[T any](api telegram.API, sl TypedSaveLoader[T], size int, msgs chan *telegram.Message) *TypedFSM[T] {
+	return &TypedFSM[T]{NewByChat(api, UntypedStore(sl), size, msgs)}
+}
+
+func (f *TypedFSM[T]) AddState(id string, enter, leave TypedAction[T]) (TypedState[T], error) {
+	st, err := f.FSM.AddState(id, enter.Untyped(), leave.Untyped())
+	return TypedState[T]{st}, err
+}
+
+func (f *TypedFSM[T]) State(id string) (TypedState[T], bool) {
+	st, ok := f.FSM.State(id)
+	return TypedState[T]{st}, ok
+}
+
+func (f *TypedFSM[T]) MakeState(sm TypedStateMaker[T]) (TypedState[T], error) {
+	st, err := f.FSM.MakeState(UntypedStateMaker(sm))
+	return TypedState[T]{st}, err
+}
+
+func (f *TypedFSM[T]) AddSubflow(flow TypedSubflow[T]) error {
+	return f.FSM.AddSubflow(flow.Untyped())
+}
+
+func (f *TypedFSM[T]) RegisterGlobal(mt string, t TypedTransitor[T]) {
+	f.FSM.RegisterGlobal(mt, t.Untyped())
+}
+
+func (f *TypedFSM[T]) RegisterGlobalCommand(cmd string, t TypedTransitor[T]) {
+	f.FSM.RegisterGlobalCommand(cmd, t.Untyped())
+}
+
+func (f *TypedFSM[T]) RegisterGlobalFallback(t TypedTransitor[T]) {
+	f.FSM.RegisterGlobalFallback(t.Untyped())
+}
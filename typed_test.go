@@ -0,0 +1,144 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Patrolavia/telegram"
+)
+
+type testCounter struct {
+	Count int
+}
+
+func TestTypedFSM(t *testing.T) {
+	u1 := makeTestUser("user1")
+	ch := make(chan *telegram.Message)
+	store := TypedMemoryStore(func(uid string) testCounter { return testCounter{} })
+	f := NewTypedBySender[testCounter](nil, store, 1, ch)
+
+	f.AddState("counted", func(msg *telegram.Message, current TypedState[testCounter], api telegram.API) error {
+		data := current.Data()
+		data.Count++
+		current.SetData(data)
+		current.Transit(InitialState)
+		return nil
+	}, nil)
+	init, _ := f.State(InitialState)
+	init.RegisterFallback(func(msg *telegram.Message, state TypedState[testCounter]) (string, error) {
+		return "counted", nil
+	})
+
+	go f.Start(0)
+	ch <- &telegram.Message{ID: 1, Text: "test", From: u1, Chat: u1}
+	ch <- &telegram.Message{ID: 2, Text: "test", From: u1, Chat: u1}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	f.Stop(ctx)
+
+	if _, data, err := store.Load(u1.Identifier()); err != nil || data.Count != 2 {
+		t.Errorf("Expected counter to be 2, got %d, err %v", data.Count, err)
+	}
+}
+
+type typedCounterState struct {
+	name  string
+	enter TypedAction[testCounter]
+	trans []TypedTransitorMap[testCounter]
+}
+
+func (s typedCounterState) Name() string { return s.name }
+func (s typedCounterState) Actions() (enter, leave TypedAction[testCounter]) {
+	return s.enter, nil
+}
+func (s typedCounterState) Transitors() []TypedTransitorMap[testCounter] { return s.trans }
+
+func TestTypedSubflowAndGlobal(t *testing.T) {
+	u1 := makeTestUser("user1")
+	ch := make(chan *telegram.Message)
+	store := TypedMemoryStore(func(uid string) testCounter { return testCounter{} })
+	f := NewTypedBySender[testCounter](nil, store, 1, ch)
+
+	count := func(msg *telegram.Message, current TypedState[testCounter], api telegram.API) error {
+		data := current.Data()
+		data.Count++
+		current.SetData(data)
+		return nil
+	}
+	err := f.AddSubflow(TypedSubflow[testCounter]{"count", "count.once", []TypedStateMaker[testCounter]{
+		typedCounterState{"count.once", func(msg *telegram.Message, current TypedState[testCounter], api telegram.API) error {
+			count(msg, current, api)
+			current.Return(nil)
+			return nil
+		}, nil},
+	}})
+	if err != nil {
+		t.Fatalf("Cannot add typed subflow: %s", err)
+	}
+	f.MakeState(typedCounterState{"done", nil, []TypedTransitorMap[testCounter]{{
+		TransitorMap: TransitorMap{State: InitialState, Type: TextMsg, Call: "count"},
+	}}})
+	counted := 0
+	f.MakeState(typedCounterState{"many", func(msg *telegram.Message, current TypedState[testCounter], api telegram.API) error {
+		count(msg, current, api)
+		counted = current.Data().Count
+		return nil
+	}, []TypedTransitorMap[testCounter]{{
+		TransitorMap: TransitorMap{State: "done", Match: TypedGuard("counted", func(msg *telegram.Message, state TypedState[testCounter]) bool {
+			return state.Data().Count > 0
+		})},
+		Transitor: func(msg *telegram.Message, state TypedState[testCounter]) (string, error) {
+			return "many", nil
+		},
+	}}})
+	f.RegisterGlobalCommand("/reset", func(msg *telegram.Message, state TypedState[testCounter]) (string, error) {
+		state.SetData(testCounter{})
+		return InitialState, nil
+	})
+
+	go f.Start(0)
+	ch <- &telegram.Message{ID: 1, Text: "call", From: u1, Chat: u1}
+	ch <- &telegram.Message{ID: 2, Text: "guarded", From: u1, Chat: u1}
+	ch <- &telegram.Message{ID: 3, Text: "/reset", From: u1, Chat: u1}
+	stopFSM(t, f.FSM)
+
+	if counted != 2 {
+		t.Errorf("Expected counter to be 2 in state[many], got %d", counted)
+	}
+	if sid, data, err := store.Load(u1.Identifier()); err != nil || sid != InitialState || data.Count != 0 {
+		t.Errorf("Expected typed global command resets counter, got %d in state[%s], err %v", data.Count, sid, err)
+	}
+}
+
+func TestTypedStoreMismatch(t *testing.T) {
+	store := TypedStore[int](MemoryStore(func(uid string) interface{} { return "string" }))
+	if _, _, err := store.Load("user"); err == nil {
+		t.Errorf("Loading data of wrong type should fail.")
+	}
+}
+
+func TestUntypedStoreChecksType(t *testing.T) {
+	mem := MemoryStore(nil)
+	store := UntypedStore(TypedStore[int](mem))
+	if err := store.Save("user", "state", "string"); err == nil {
+		t.Errorf("Saving data of wrong type should fail.")
+	}
+	if unwrap(store) != mem {
+		t.Errorf("Optional interfaces of wrapped store should be kept.")
+	}
+
+	if err := store.Save("user", "state", Record{"string", []string{"a"}, nil}); err == nil {
+		t.Errorf("Saving record with data of wrong type should fail.")
+	}
+	if err := store.Save("user", "state", Record{1, []string{"a"}, nil}); err != nil {
+		t.Fatalf("Cannot save record: %s", err)
+	}
+	if _, data, err := store.Load("user"); err != nil || data.(Record).Data != 1 || data.(Record).History[0] != "a" {
+		t.Errorf("Record does not round-trip, got %#v, err %v", data, err)
+	}
+}
@@ -0,0 +1,229 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// IssueKind classifies problems found by FSM.Validate.
+type IssueKind string
+
+// valid issue kinds
+const (
+	UnknownState     IssueKind = "unknown state"     // referred state is not registered
+	Unreachable      IssueKind = "unreachable"       // no path from InitialState
+	DeadEnd          IssueKind = "dead end"          // no transitor leaving the state
+	DuplicateCommand IssueKind = "duplicate command" // same command registered twice on a state
+	NoWayBack        IssueKind = "no way back"       // no path to InitialState
+)
+
+// Issue is a problem of the state map.
+type Issue struct {
+	Kind   IssueKind
+	State  string
+	Detail string
+}
+
+func (i Issue) String() string {
+	ret := fmt.Sprintf("%s: state[%s]", i.Kind, i.State)
+	if i.Detail != "" {
+		ret += " " + i.Detail
+	}
+	return ret
+}
+
+// Report lists issues found by FSM.Validate. It is an error so Start can
+// return it in strict mode.
+type Report []Issue
+
+func (r Report) Error() string {
+	desc := make([]string, len(r))
+	for i, issue := range r {
+		desc[i] = issue.String()
+	}
+	return "Invalid state map: " + strings.Join(desc, "; ")
+}
+
+func (f *fsm) SetStrict(strict bool) {
+	f.strict = strict
+}
+
+func (f *fsm) OnReport(h func(r Report)) {
+	f.reporter = h
+}
+
+// validate runs Validate for Start, returning the report in strict mode,
+// passing it to reporter, or logging it if reporter is not set.
+func (f *fsm) validate() error {
+	r := f.Validate()
+	if len(r) == 0 {
+		return nil
+	}
+	if f.strict {
+		return r
+	}
+	if f.reporter != nil {
+		f.reporter(r)
+		return nil
+	}
+	for _, issue := range r {
+		log.Printf("botgoram: %s", issue)
+	}
+	return nil
+}
+
+// Validate analyzes transitors declared by StateMakers. Transitors registered
+// directly on State are invisible to it, so states added by AddState are only
+// checked when referred.
+func (f *fsm) Validate() (ret Report) {
+	edges := make(map[string]map[string]bool)
+	edge := func(from, to string) {
+		if edges[from] == nil {
+			edges[from] = make(map[string]bool)
+		}
+		edges[from][to] = true
+	}
+	known := func(id, detail string) bool {
+		if _, ok := f.states[id]; ok {
+			return true
+		}
+		ret = append(ret, Issue{UnknownState, id, detail})
+		return false
+	}
+
+	var globals []string
+	returns := make(map[string][]string) // flow name to return states
+	commands := make(map[[2]string]string)
+	makers := make(map[string]bool)
+	for _, s := range f.sm {
+		n := s.Name()
+		makers[n] = true
+		if p, ok := unwrap(s).(Nested); ok && p.Parent() != "" {
+			known(p.Parent(), fmt.Sprintf("is parent of state[%s]", n))
+		}
+		if r, ok := unwrap(s).(ErrorRecoverer); ok {
+			if _, es := r.ErrorRecovery(); es != "" && known(es, fmt.Sprintf("is error state of state[%s]", n)) {
+				edge(n, es)
+			}
+		}
+
+		for _, t := range s.Transitors() {
+			src := t.State
+			switch {
+			case t.IsGlobal:
+				src = "*"
+				if !t.IsHidden {
+					globals = append(globals, n)
+				}
+			case t.IsHidden:
+				if known(src, fmt.Sprintf("is entered by Transit in state[%s]", n)) {
+					edge(n, src)
+				}
+				continue
+			case !known(src, fmt.Sprintf("has transitor to state[%s]", n)):
+				continue
+			case t.Call != "":
+				flow, ok := f.flows[t.Call]
+				if !ok {
+					ret = append(ret, Issue{UnknownState, src, fmt.Sprintf("calls unknown subflow %s", t.Call)})
+					continue
+				}
+				edge(src, flow.Entry)
+				returns[t.Call] = append(returns[t.Call], n)
+			default:
+				edge(src, n)
+			}
+
+			if t.Command == "" || t.Type != TextMsg || t.Timeout > 0 || t.IsFallback ||
+				t.IsCallback || t.IsEdited || t.IsForward || t.IsReply {
+				continue
+			}
+			key := [2]string{src, t.Command}
+			if prev, ok := commands[key]; ok {
+				ret = append(ret, Issue{DuplicateCommand, src, fmt.Sprintf("registers %s to state[%s] and state[%s]", t.Command, prev, n)})
+			}
+			commands[key] = n
+		}
+	}
+
+	ids := make([]string, 0, len(f.states))
+	for id := range f.states {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if f.checkGroups() == nil {
+		// inherited transitors
+		for _, id := range ids {
+			for _, p := range f.ancestors(id) {
+				for to := range edges[p.state.ID()] {
+					edge(id, to)
+				}
+			}
+		}
+	}
+	for _, id := range ids {
+		for _, to := range globals {
+			edge(id, to)
+		}
+	}
+	// states of subflow without transitors might return to callers
+	for name, flow := range f.flows {
+		for _, sm := range flow.States {
+			if len(edges[sm.Name()]) > 0 {
+				continue
+			}
+			for _, to := range returns[name] {
+				edge(sm.Name(), to)
+			}
+		}
+	}
+
+	reachable := walk(InitialState, edges)
+	reverse := make(map[string]map[string]bool)
+	for from, tos := range edges {
+		for to := range tos {
+			if reverse[to] == nil {
+				reverse[to] = make(map[string]bool)
+			}
+			reverse[to][from] = true
+		}
+	}
+	back := walk(InitialState, reverse)
+
+	for _, id := range ids {
+		if !makers[id] {
+			continue
+		}
+		switch {
+		case !reachable[id]:
+			ret = append(ret, Issue{Unreachable, id, ""})
+		case len(edges[id]) == 0:
+			ret = append(ret, Issue{DeadEnd, id, ""})
+		case !back[id]:
+			ret = append(ret, Issue{NoWayBack, id, ""})
+		}
+	}
+	return
+}
+
+// walk returns states reachable from start.
+func walk(start string, edges map[string]map[string]bool) map[string]bool {
+	visited := map[string]bool{start: true}
+	queue := []string{start}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for next := range edges[cur] {
+			if !visited[next] {
+				visited[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+	return visited
+}
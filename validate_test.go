@@ -0,0 +1,99 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/Patrolavia/telegram"
+)
+
+func makeValidateFSM() FSM {
+	f := NewBySender(nil, MemoryStore(nil), 1, make(chan *telegram.Message))
+	makers := []flowState{
+		{"a", nil, []TransitorMap{
+			{State: InitialState, Type: TextMsg, Command: "/a"},
+			{State: InitialState, Type: TextMsg, Command: "/a"},
+			{State: InitialState, IsHidden: true},
+		}},
+		{"b", nil, []TransitorMap{{State: "a", Type: TextMsg}}},
+		{"c", nil, []TransitorMap{{State: "ghost", Type: TextMsg}}},
+		{"d", nil, []TransitorMap{{State: "a", Type: PhotoMsg}, {State: "e", Type: TextMsg}}},
+		{"e", nil, []TransitorMap{{State: "d", Type: TextMsg}}},
+	}
+	for _, m := range makers {
+		f.MakeState(m)
+	}
+	return f
+}
+
+func sortIssues(r Report) {
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].Kind != r[j].Kind {
+			return r[i].Kind < r[j].Kind
+		}
+		if r[i].State != r[j].State {
+			return r[i].State < r[j].State
+		}
+		return r[i].Detail < r[j].Detail
+	})
+}
+
+func TestValidate(t *testing.T) {
+	expect := Report{
+		{DuplicateCommand, InitialState, "registers /a to state[a] and state[a]"},
+		{UnknownState, "ghost", "has transitor to state[c]"},
+		{DeadEnd, "b", ""},
+		{Unreachable, "c", ""},
+		{NoWayBack, "d", ""},
+		{NoWayBack, "e", ""},
+	}
+	actual := makeValidateFSM().Validate()
+	sortIssues(expect)
+	sortIssues(actual)
+	if len(actual) != len(expect) {
+		t.Fatalf("Expected %d issues, got %v", len(expect), actual)
+	}
+	for i := range expect {
+		if actual[i] != expect[i] {
+			t.Errorf("Expected issue %s, got %s", expect[i], actual[i])
+		}
+	}
+}
+
+func TestValidateOnStart(t *testing.T) {
+	f := makeValidateFSM()
+	f.SetStrict(true)
+	if _, ok := f.Start(0).(Report); !ok {
+		t.Errorf("Expected Start returns Report in strict mode")
+	}
+
+	f = makeValidateFSM()
+	var reported Report
+	f.OnReport(func(r Report) { reported = r })
+	if err := f.Start(0); !errors.Is(err, ErrStateNotFound) {
+		t.Errorf("Expected Start returns ErrStateNotFound, got %v", err)
+	}
+	if len(reported) != 6 {
+		t.Errorf("Expected issues passed to OnReport handler, got %v", reported)
+	}
+}
+
+func TestStartRetry(t *testing.T) {
+	f := makeValidateFSM()
+	if err := f.Start(0); !errors.Is(err, ErrStateNotFound) {
+		t.Fatalf("Expected Start returns ErrStateNotFound, got %v", err)
+	}
+	f.AddState("ghost", nil, nil)
+	if err := f.(*fsm).prepare(); err != nil {
+		t.Fatalf("Expected preparing succeeds after fixing state map, got %s", err)
+	}
+
+	a, _ := f.State(InitialState)
+	if n := len(a.(*state).command["/a"]); n != 2 {
+		t.Errorf("Expected transitors registered once, got %d", n)
+	}
+}
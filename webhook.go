@@ -0,0 +1,82 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"github.com/Patrolavia/telegram"
+)
+
+// SecretTokenHeader is the header Telegram uses to send secret token of webhook.
+const SecretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// max size of an update we accept
+const maxUpdateSize = 1 << 20
+
+type webhookUpdate struct {
+	ID            int64                   `json:"update_id"`
+	Message       *telegram.Message       `json:"message"`
+	EditedMessage *telegram.Message       `json:"edited_message"`
+	CallbackQuery *telegram.CallbackQuery `json:"callback_query"`
+}
+
+type webhook struct {
+	manager *manager
+	secret  []byte
+}
+
+// NewWebhook creates a http.Handler receiving updates from Telegram webhook and
+// feeding them to f, so you can mount it in your own HTTP server.
+//
+// Requests without matching secret token are rejected with 403, leave secret empty
+// to skip the check. When message queue of f is full, it responds 503 and Telegram
+// will deliver the update later.
+//
+// Messages, edited messages and callback queries are accepted, other update types
+// are ignored. Call f.DisableLongPolling() if f is created with nil message channel.
+// f must be created by NewBySender or NewByChat (or FSM field of TypedFSM).
+func NewWebhook(f FSM, secret string) http.Handler {
+	return &webhook{f.(*fsm).manager, []byte(secret)}
+}
+
+func (h *webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(h.secret) > 0 && subtle.ConstantTimeCompare([]byte(r.Header.Get(SecretTokenHeader)), h.secret) != 1 {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	var upd webhookUpdate
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxUpdateSize)).Decode(&upd); err != nil {
+		http.Error(w, "malformed update", http.StatusBadRequest)
+		return
+	}
+
+	var u *update
+	switch {
+	case upd.Message != nil:
+		u = messageUpdate(upd.Message)
+	case upd.EditedMessage != nil:
+		u = editedUpdate(upd.EditedMessage)
+	case upd.CallbackQuery != nil:
+		u = callbackUpdate(upd.CallbackQuery)
+	default: // unsupported update type
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if !h.manager.tryFeed(u) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "queue is full", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,68 @@
+// This file is part of Botgoram
+// Botgoram is free software: see LICENSE.txt for more details.
+
+package botgoram
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Patrolavia/telegram"
+)
+
+func TestWebhook(t *testing.T) {
+	f := NewBySender(nil, MemoryStore(func(uid string) interface{} { return nil }), 1, nil)
+	f.DisableLongPolling()
+	if f.(*fsm).fetcher != nil {
+		t.Fatalf("Expected long-polling fetcher disabled")
+	}
+	srv := httptest.NewServer(NewWebhook(f, "secret"))
+	defer srv.Close()
+
+	post := func(secret, body string) int {
+		req, _ := http.NewRequest("POST", srv.URL, strings.NewReader(body))
+		req.Header.Set(SecretTokenHeader, secret)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Cannot send request: %s", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	msg := `{"update_id":1,"message":{"message_id":1,"text":"hi","from":{"id":1},"chat":{"id":1}}}`
+
+	if code := post("wrong", msg); code != http.StatusForbidden {
+		t.Errorf("Expected 403 with wrong secret, got %d", code)
+	}
+	if code := post("secret", "not json"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 with malformed update, got %d", code)
+	}
+	if code := post("secret", `{"update_id":2,"inline_query":{}}`); code != http.StatusOK {
+		t.Errorf("Expected 200 for ignored update type, got %d", code)
+	}
+	if code := post("secret", msg); code != http.StatusOK {
+		t.Errorf("Expected 200 when queueing message, got %d", code)
+	}
+	// fsm is not started, so queue of size 1 is full now
+	if code := post("secret", msg); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 when queue is full, got %d", code)
+	}
+	if resp, _ := http.Get(srv.URL); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET, got %d", resp.StatusCode)
+	}
+}
+
+func TestTryFeedRespectsRunningUsers(t *testing.T) {
+	m := newManager(bySender, 1, make(chan *telegram.Message))
+	u1 := makeTestUser("user1")
+	u2 := makeTestUser("user2")
+	if !m.tryFeed(messageUpdate(&telegram.Message{ID: 1, From: u1, Chat: u1})) {
+		t.Fatalf("Expected message queued")
+	}
+	m.Begin() // user1 is running, queue is empty
+	if m.tryFeed(messageUpdate(&telegram.Message{ID: 2, From: u2, Chat: u2})) {
+		t.Errorf("Expected message refused when running users reach limit")
+	}
+}